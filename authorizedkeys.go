@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// errAuthorizedKeysChanged is returned when authorized_keys is changed on the
+// host between reading and writing it.
+var errAuthorizedKeysChanged = errors.New("authorized_keys was changed while it was edited")
+
+// exitAuthorizedKeysChanged is the exit status of the write script when the
+// file is not the one that was read.
+const exitAuthorizedKeysChanged = 75
+
+// userName matches the user names that are safe to expand with ~ in a shell.
+var userName = regexp.MustCompile(`^[A-Za-z0-9._][A-Za-z0-9._-]*$`)
+
+var authorizedKeysCommand = cli.Command{
+	Name:  "authorized-keys",
+	Usage: "add, remove or sync keys in ~/.ssh/authorized_keys on all hosts",
+	Description: `The keys of KEYFILE, in the authorized_keys format, are added to or removed from
+   ~/.ssh/authorized_keys of the user on every host. The options and comments of the
+   lines that are kept are preserved and the file is only written when it changes,
+   under a lock and after copying it to authorized_keys.bak. Use --become when the
+   user is not the one connected as.`,
+	Subcommands: []cli.Command{
+		{
+			Name:      "add",
+			Usage:     "add the keys that are not authorized yet",
+			ArgsUsage: "KEYFILE",
+			Flags:     authorizedKeysFlags,
+			Action:    authorizedKeysAction(keysAdd),
+		},
+		{
+			Name:      "remove",
+			Usage:     "remove the keys",
+			ArgsUsage: "KEYFILE",
+			Flags:     authorizedKeysFlags,
+			Action:    authorizedKeysAction(keysRemove),
+		},
+		{
+			Name:  "sync",
+			Usage: "add the keys and remove all other keys",
+			Description: `The keys of KEYFILE are added first. Before any other key is removed, logging in
+   as the user with the private key of --verify-identity, KEYFILE without .pub by
+   default, is checked so that rotating keys does not lock the user out.`,
+			ArgsUsage: "KEYFILE",
+			Flags: append([]cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "verify-identity",
+					Usage: "private key of one of the keys to check logging in with before removing the other keys",
+				},
+				cli.BoolFlag{
+					Name:  "no-verify",
+					Usage: "remove the other keys without checking that one of the keys can log in",
+				},
+			}, authorizedKeysFlags...),
+			Action: authorizedKeysAction(keysSync),
+		},
+	},
+}
+
+var authorizedKeysFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "for-user",
+		Usage: "user whose authorized_keys are edited, the user connected as by default",
+	},
+	cli.StringFlag{
+		Name:  "file",
+		Usage: "authorized keys file like AuthorizedKeysFile of sshd, relative to the home directory of the user and %u is the user",
+		Value: ".ssh/authorized_keys",
+	},
+}
+
+// The ways authorized_keys is edited with the keys.
+const (
+	keysAdd    = "add"
+	keysRemove = "remove"
+	keysSync   = "sync"
+)
+
+func authorizedKeysAction(mode string) func(*cli.Context) error {
+	return func(context *cli.Context) error {
+		if context.NArg() != 1 {
+			return fmt.Errorf("KEYFILE must be specified")
+		}
+		keyfile := context.Args().First()
+		data, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return err
+		}
+		keys, err := parseKeyFile(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", keyfile, err)
+		}
+		forUser := context.String("for-user")
+		if forUser != "" && !userName.MatchString(forUser) {
+			return fmt.Errorf("invalid user name %q", forUser)
+		}
+		become, err := newBecome(context)
+		if err != nil {
+			return err
+		}
+
+		e := &keysEditor{
+			mode:    mode,
+			keys:    keys,
+			forUser: forUser,
+			file:    context.String("file"),
+			become:  become,
+		}
+		if mode == keysSync && !context.Bool("no-verify") {
+			e.verify = context.StringSlice("verify-identity")
+			if len(e.verify) == 0 && strings.HasSuffix(keyfile, ".pub") {
+				if _, err := os.Stat(strings.TrimSuffix(keyfile, ".pub")); err == nil {
+					e.verify = []string{strings.TrimSuffix(keyfile, ".pub")}
+				}
+			}
+			if len(e.verify) == 0 {
+				return fmt.Errorf("no private key to check logging in with before removing keys, use --verify-identity or --no-verify")
+			}
+		}
+
+		m, err := newMultiplexer(context)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+		e.runner = m.runner
+
+		_, err = m.run(func(_ gocontext.Context, j *job, session *runner.Session) error {
+			return e.edit(j, session)
+		})
+		return err
+	}
+}
+
+// authorizedLine is a line of an authorized_keys file.
+type authorizedLine struct {
+	text string
+	// key is nil for comments, empty and invalid lines
+	key ssh.PublicKey
+}
+
+// parseAuthorizedKeys splits the content of an authorized_keys file in lines,
+// keeping each line as it is.
+func parseAuthorizedKeys(data []byte) []authorizedLine {
+	if len(data) == 0 {
+		return nil
+	}
+	var lines []authorizedLine
+	for _, text := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		l := authorizedLine{text: text}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(text)); err == nil {
+			l.key = key
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+// parseKeyFile returns the keys of the file, with their options and comments.
+func parseKeyFile(data []byte) ([]authorizedLine, error) {
+	var keys []authorizedLine
+	for i, l := range parseAuthorizedKeys(data) {
+		text := strings.TrimSpace(l.text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if l.key == nil {
+			return nil, fmt.Errorf("invalid key on line %d", i+1)
+		}
+		keys = append(keys, authorizedLine{text: text, key: l.key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keys, nil
+}
+
+// formatAuthorizedKeys returns the content of an authorized_keys file with the lines.
+func formatAuthorizedKeys(lines []authorizedLine) []byte {
+	var b bytes.Buffer
+	for _, l := range lines {
+		b.WriteString(l.text)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// hasKey returns whether the key is one of the keys of the lines.
+func hasKey(lines []authorizedLine, key ssh.PublicKey) bool {
+	for _, l := range lines {
+		if l.key != nil && bytes.Equal(l.key.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// addKeys returns the lines with the keys that are not in them yet appended and the added keys.
+func addKeys(lines, keys []authorizedLine) (result, added []authorizedLine) {
+	result = append(result, lines...)
+	for _, k := range keys {
+		if !hasKey(result, k.key) {
+			result = append(result, k)
+			added = append(added, k)
+		}
+	}
+	return result, added
+}
+
+// removeKeys returns the lines without the lines of the keys for which remove
+// returns true and the removed lines.
+func removeKeys(lines []authorizedLine, remove func(ssh.PublicKey) bool) (result, removed []authorizedLine) {
+	for _, l := range lines {
+		if l.key != nil && remove(l.key) {
+			removed = append(removed, l)
+			continue
+		}
+		result = append(result, l)
+	}
+	return result, removed
+}
+
+// describeKey returns the type, fingerprint and comment of the key of the line.
+func describeKey(l authorizedLine) string {
+	s := l.key.Type() + " " + ssh.FingerprintSHA256(l.key)
+	if _, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(l.text)); err == nil && comment != "" {
+		s += " " + comment
+	}
+	return s
+}
+
+// keysEditor edits authorized_keys on the hosts.
+type keysEditor struct {
+	mode    string
+	keys    []authorizedLine
+	forUser string
+	// file is the path of authorized_keys, relative to the home directory of the user
+	file   string
+	become *become
+	// verify are the private keys to check logging in with before removing keys
+	verify []string
+	runner *runner.Runner
+}
+
+// edit applies the keys to authorized_keys on the host and writes the changes
+// to the output of the job, it's read again when it's changed meanwhile.
+func (e *keysEditor) edit(j *job, session *runner.Session) error {
+	user := e.forUser
+	if user == "" {
+		user = j.user
+	}
+	// the user of the host comes from the ssh config or the command line
+	if !userName.MatchString(user) {
+		return fmt.Errorf("invalid user name %q", user)
+	}
+	w := newWriter(j)
+	for attempt := 1; ; attempt++ {
+		err := e.apply(j, session, user, w)
+		if err != errAuthorizedKeysChanged || attempt == 3 {
+			return err
+		}
+		log.Debugf("authorized_keys of %s on %s changed while it was edited, retrying", user, j.host)
+	}
+}
+
+func (e *keysEditor) apply(j *job, session *runner.Session, user string, w io.Writer) error {
+	path, data, err := readAuthorizedKeys(session, e.become, user, strings.Replace(e.file, "%u", user, -1))
+	if err != nil {
+		return err
+	}
+	lines := parseAuthorizedKeys(data)
+
+	var added, removed []authorizedLine
+	result := lines
+	if e.mode == keysAdd || e.mode == keysSync {
+		result, added = addKeys(result, e.keys)
+	}
+	switch e.mode {
+	case keysRemove:
+		result, removed = removeKeys(result, func(key ssh.PublicKey) bool { return hasKey(e.keys, key) })
+	case keysSync:
+		result, removed = removeKeys(result, func(key ssh.PublicKey) bool { return !hasKey(e.keys, key) })
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Fprintf(w, "%s unchanged\n", path)
+		return nil
+	}
+
+	if len(removed) > 0 && len(e.verify) > 0 {
+		// the keys are added before checking that they can log in
+		if len(added) > 0 {
+			withAdded, _ := addKeys(lines, e.keys)
+			if err := writeAuthorizedKeys(session, e.become, user, path, data, formatAuthorizedKeys(withAdded)); err != nil {
+				return err
+			}
+			printKeys(w, "+", added)
+			added = nil
+			data = formatAuthorizedKeys(withAdded)
+		}
+		if err := e.verifyLogin(j, session, user, w); err != nil {
+			return err
+		}
+	}
+	if err := writeAuthorizedKeys(session, e.become, user, path, data, formatAuthorizedKeys(result)); err != nil {
+		return err
+	}
+	printKeys(w, "+", added)
+	printKeys(w, "-", removed)
+	return nil
+}
+
+// verifyLogin checks that the user can log in with one of the private keys.
+func (e *keysEditor) verifyLogin(j *job, session *runner.Session, user string, w io.Writer) error {
+	h := &runner.Host{Name: j.name, Index: j.index, Addr: j.host, User: j.user, Options: session.Options}
+	var errs []string
+	for _, identity := range e.verify {
+		s, err := e.runner.ConnectIdentity(gocontext.Background(), h, user, identity)
+		if err == nil {
+			s.Close()
+			fmt.Fprintf(w, "%s can log in as %s\n", identity, user)
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", identity, err))
+	}
+	return fmt.Errorf("no key can log in as %s, the other keys are kept - %s", user, strings.Join(errs, ", "))
+}
+
+func printKeys(w io.Writer, prefix string, lines []authorizedLine) {
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s %s\n", prefix, describeKey(l))
+	}
+}
+
+// readAuthorizedKeys returns the path and the content of the authorized keys file
+// of the user on the host, the content is empty when the file does not exist.
+func readAuthorizedKeys(session *runner.Session, b *become, user, file string) (string, []byte, error) {
+	script := authorizedKeysPath(user, file) + `
+printf '%s\n' "$f"
+[ ! -e "$f" ] || cat "$f"`
+	out, err := runScript(session, b, script, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	i := bytes.IndexByte(out, '\n')
+	if i < 0 {
+		return "", nil, fmt.Errorf("unexpected output reading authorized_keys: %q", out)
+	}
+	return string(out[:i]), out[i+1:], nil
+}
+
+// writeAuthorizedKeys replaces the content of authorized_keys of the user with
+// data when its content is still old. The file is copied to authorized_keys.bak
+// and replaced with a temporary file while holding a lock, the lock of flock on
+// the .ssh directory or a lock directory when flock is not available. The data is
+// sent on the stdin of the script and the content is compared with the checksum
+// of old so that the size of the script does not depend on the file.
+func writeAuthorizedKeys(session *runner.Session, b *become, user, path string, old, data []byte) error {
+	script := fmt.Sprintf(`u=%s
+f=%s
+old=%s
+d=$(dirname "$f")
+lock= tmp=
+trap 'rm -f "$tmp"; [ -z "$lock" ] || rmdir "$lock"' EXIT
+if [ ! -d "$d" ]; then
+	mkdir -m 700 "$d" || exit 1
+	[ "$(id -u)" != 0 ] || chown "$u" "$d" || exit 1
+fi
+if command -v flock >/dev/null 2>&1; then
+	exec 9<"$d"
+	flock -w 30 9 || { echo "timed out waiting for the lock of $d" >&2; exit 1; }
+else
+	n=0
+	until mkdir "$f.lock" 2>/dev/null; do
+		n=$((n+1))
+		[ $n -lt 30 ] || { echo "timed out waiting for the lock $f.lock" >&2; exit 1; }
+		sleep 1
+	done
+	lock="$f.lock"
+fi
+if [ -e "$f" ]; then
+	set -- $(cksum <"$f")
+else
+	set -- $(cksum </dev/null)
+fi
+[ "$1 $2" = "$old" ] || exit %d
+tmp="$d/.authorized_keys.slex-$$"
+cat >"$tmp" && chmod 600 "$tmp" || exit 1
+[ "$(id -u)" != 0 ] || chown "$u" "$tmp" || exit 1
+[ ! -e "$f" ] || cp -p "$f" "$f.bak" || exit 1
+mv -f "$tmp" "$f" && tmp=`,
+		shellQuote(user), shellQuote(path), shellQuote(cksum(old)), exitAuthorizedKeysChanged)
+	_, err := runScript(session, b, script, bytes.NewReader(data))
+	if exitErr, ok := err.(*scriptError); ok && exitErr.ExitStatus() == exitAuthorizedKeysChanged {
+		return errAuthorizedKeysChanged
+	}
+	return err
+}
+
+// authorizedKeysPath returns the shell setting $f to the path of the file, relative
+// to the home directory of the user. The user name must match userName.
+func authorizedKeysPath(user, file string) string {
+	if strings.HasPrefix(file, "/") {
+		return "f=" + shellQuote(file)
+	}
+	return fmt.Sprintf(`u=%s
+h=$(getent passwd "$u" 2>/dev/null | cut -d: -f6)
+[ -n "$h" ] || h=$(eval "echo ~$u")
+case "$h" in
+/*) ;;
+*) echo "no home directory for $u" >&2; exit 1 ;;
+esac
+f="$h/"%s`, shellQuote(user), shellQuote(file))
+}
+
+// runScript executes the script with sh on the host, with sudo when become is
+// set, and returns its stdout. The stdin of the script is read from stdin when
+// it's not nil.
+func runScript(session *runner.Session, b *become, script string, stdin io.Reader) ([]byte, error) {
+	s, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Session.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := "sh -c " + shellQuote(script)
+	var filter *sudoFilter
+	if b != nil {
+		cmd = b.wrap(script, false)
+		if filter, err = b.start(s, &stderr, stdin); err != nil {
+			return nil, err
+		}
+	} else {
+		s.Stderr, s.Stdin = &stderr, stdin
+	}
+	s.Stdout = &stdout
+	err = s.Run(cmd)
+	if filter != nil {
+		err = filter.result(err)
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return nil, &scriptError{ExitError: exitErr, msg: strings.TrimSpace(stderr.String())}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// scriptError is the exit status of a script with what it wrote to stderr.
+type scriptError struct {
+	*ssh.ExitError
+	msg string
+}
+
+func (e *scriptError) Error() string {
+	if e.msg == "" {
+		return e.ExitError.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.ExitError, e.msg)
+}
+
+// cksum returns the checksum and the size of data as printed by the POSIX cksum
+// utility for its stdin.
+func cksum(data []byte) string {
+	var crc uint32
+	update := func(b byte) {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	for _, b := range data {
+		update(b)
+	}
+	// the length is appended with its least significant byte first
+	for n := len(data); n > 0; n >>= 8 {
+		update(byte(n))
+	}
+	return fmt.Sprintf("%d %d", ^crc, len(data))
+}
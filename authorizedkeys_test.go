@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEditAuthorizedKeys(t *testing.T) {
+	const (
+		a = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGkSjpwCsbzDIfDuZC+STzuKZsnCdH7yZiNOxWmz9sK6"
+		b = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAICE/92VkaaDJjkIDOPJRfTbAFeXjAqDFb0qdOsjEiT3i"
+	)
+	lines := parseAuthorizedKeys([]byte("command=\"ls\",no-pty " + a + " alice\n\n# comment\nnot a key"))
+	keys, err := parseKeyFile([]byte("# new keys\n" + a + " alice@laptop\n" + b + " bob\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, added := addKeys(lines, keys)
+	if len(added) != 1 || added[0].text != b+" bob" {
+		t.Fatalf("expected only the key of bob to be added, got %v", added)
+	}
+	expected := "command=\"ls\",no-pty " + a + " alice\n\n# comment\nnot a key\n" + b + " bob\n"
+	if got := string(formatAuthorizedKeys(result)); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	result, removed := removeKeys(result, func(key ssh.PublicKey) bool { return hasKey(keys[:1], key) })
+	if len(removed) != 1 || removed[0].text != "command=\"ls\",no-pty "+a+" alice" {
+		t.Fatalf("expected the line of the key of alice to be removed with its options, got %v", removed)
+	}
+	expected = "\n# comment\nnot a key\n" + b + " bob\n"
+	if got := string(formatAuthorizedKeys(result)); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	if _, err := parseKeyFile([]byte(a + "\nnot a key\n")); err == nil {
+		t.Error("expected an error for the invalid key")
+	}
+}
+
+func TestCksum(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected string
+	}{
+		{data: "", expected: "4294967295 0"},
+		{data: "hello\n", expected: "3015617425 6"},
+		{data: strings.Repeat("a", 70000), expected: "3508083167 70000"},
+	} {
+		if got := cksum([]byte(tc.data)); got != tc.expected {
+			t.Errorf("expected the checksum of %d bytes to be %q, got %q", len(tc.data), tc.expected, got)
+		}
+	}
+}
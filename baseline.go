@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// baseline is the output the output of each host is compared with.
+type baseline struct {
+	// host is the host whose output is the baseline of all hosts
+	host string
+	// run is the state of a previous run, the output of each host in it is
+	// the baseline of the host
+	run     *runState
+	runPath string
+}
+
+// newBaseline returns the baseline of the --diff-against and --diff-against-run
+// flags or nil when neither is set.
+func newBaseline(context *cli.Context, m *multiplexer) (*baseline, error) {
+	host, run := context.GlobalString("diff-against"), context.GlobalString("diff-against-run")
+	switch {
+	case host == "" && run == "":
+		return nil, nil
+	case host != "" && run != "":
+		return nil, fmt.Errorf("--diff-against and --diff-against-run can't be used together")
+	case context.GlobalBool("quiet"):
+		return nil, fmt.Errorf("the output is compared with the baseline, it can't be disabled with --quiet")
+	}
+	if host != "" {
+		if !m.hasHost(host) {
+			return nil, fmt.Errorf("the baseline %s is not one of the hosts", host)
+		}
+		return &baseline{host: host}, nil
+	}
+	// the state is loaded before the run replaces it when it's the last run
+	s, err := loadState(run)
+	if err != nil {
+		return nil, err
+	}
+	return &baseline{run: s, runPath: run}, nil
+}
+
+// printDiffs writes the differences between the output of each job and its
+// baseline as unified diffs, the hosts matching the baseline on one line.
+func printDiffs(w io.Writer, jobs []*job, b *baseline) {
+	var (
+		base    *job
+		matches []string
+	)
+	for _, j := range jobs {
+		if j.name == b.host {
+			base = j
+		}
+	}
+	if base != nil && !base.connected {
+		fmt.Fprintf(w, "the baseline %s failed: %v\n", base.name, base.err)
+		return
+	}
+
+	for _, j := range jobs {
+		if j == base {
+			continue
+		}
+		if !j.connected {
+			fmt.Fprintf(w, "%s: no output, %v\n", j.name, j.err)
+			continue
+		}
+		name, lines := b.host, []string(nil)
+		if base != nil {
+			lines = base.lines
+		} else {
+			h := b.previous(j.name)
+			if h == nil {
+				fmt.Fprintf(w, "%s: not in the run of %s\n", j.name, b.runPath)
+				continue
+			}
+			var err error
+			if lines, err = b.run.output(h); err != nil {
+				fmt.Fprintf(w, "%s: no output in the run of %s, %v\n", j.name, b.runPath, err)
+				continue
+			}
+			if lines == nil {
+				fmt.Fprintf(w, "%s: no output saved in the run of %s, use --save-output\n", j.name, b.runPath)
+				continue
+			}
+			name = j.name + " in " + b.runPath
+		}
+		if !unifiedDiff(w, name, j.name, lines, j.lines) {
+			matches = append(matches, j.name)
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+	case base != nil:
+		fmt.Fprintf(w, "%d hosts match %s: %s\n", len(matches), base.name, strings.Join(matches, ", "))
+	default:
+		fmt.Fprintf(w, "%d hosts match the run of %s: %s\n", len(matches), b.runPath, strings.Join(matches, ", "))
+	}
+}
+
+// previous returns the state of the host in the previous run, nil when it
+// was not run or could not be connected to.
+func (b *baseline) previous(host string) *hostState {
+	for _, h := range b.run.Hosts {
+		if h.Host == host && (h.Status == hostOK || h.Status == hostFailed) {
+			return h
+		}
+	}
+	return nil
+}
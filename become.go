@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	errIncorrectSudoPassword = errors.New("incorrect sudo password")
+	errSudoPasswordRequired  = errors.New("sudo password required, use --ask-become-pass")
+)
+
+// sudoPasswordRequired is printed by sudo -n when a password is needed.
+var sudoPasswordRequired = []byte("sudo: a password is required")
+
+// newBecome returns the sudo configuration from the context or nil
+// when commands are not executed with sudo. The password is asked once
+// and used for all hosts.
+func newBecome(context *cli.Context) (*become, error) {
+	if !context.GlobalBool("become") {
+		return nil, nil
+	}
+	b := &become{
+		user: context.GlobalString("become-user"),
+	}
+	if context.GlobalBool("ask-become-pass") {
+		fd := int(os.Stdin.Fd())
+		if !terminal.IsTerminal(fd) {
+			return nil, fmt.Errorf("the become password can only be read from a terminal")
+		}
+		fmt.Fprint(os.Stderr, "BECOME password: ")
+		pass, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		b.password = pass
+
+		// The prompt is unique so that it's not mistaken for the output of the command.
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		b.prompt = fmt.Sprintf("[slex-sudo-%s]", hex.EncodeToString(id))
+		b.started = fmt.Sprintf("[slex-started-%s]", hex.EncodeToString(id))
+	}
+	return b, nil
+}
+
+// become executes commands as another user with sudo.
+type become struct {
+	// user is the user to execute commands as, root when empty
+	user string
+	// password is written to sudo when it prompts for it, sudo is
+	// executed non-interactively when no password is set
+	password []byte
+	prompt   string
+	// started is printed by the command before it runs once sudo no longer
+	// reads the password, it's only set with the password
+	started string
+}
+
+// wrap returns the command executed by sudo. When interactive, sudo prompts
+// for the password on the terminal attached to the session.
+func (b *become) wrap(cmd string, interactive bool) string {
+	sudo := "sudo -n"
+	switch {
+	case interactive:
+		sudo = "sudo"
+	case b.password != nil:
+		sudo = "sudo -S -p " + shellQuote(b.prompt)
+		// printed to stderr like the prompt so that they keep their order
+		cmd = "echo " + shellQuote(b.started) + " >&2\n" + cmd
+	}
+	if b.user != "" {
+		sudo += " -u " + shellQuote(b.user)
+	}
+	return sudo + " -- sh -c " + shellQuote(cmd)
+}
+
+// start sets the stderr of the session to w, hiding the password prompts of sudo
+// and the start of the command, and answers the first prompt with the password.
+// The stdout of the session is left as it is, sudo only writes to stderr. The input,
+// when not nil, is the stdin of the command, it's written once sudo read the password.
+func (b *become) start(session *runner.Session, w io.Writer, input io.Reader) (*sudoFilter, error) {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	f := &sudoFilter{
+		w:      w,
+		prompt: []byte(b.prompt),
+	}
+	if b.password == nil {
+		session.Stdin = input
+	} else {
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		f.stdin = stdin
+		f.input = input
+		f.password = b.password
+		f.started = []byte(b.started + "\n")
+	}
+	session.Stderr = f
+	return f, nil
+}
+
+// sudoFilter removes the password prompts of sudo and the line printed when the
+// command starts from the stderr of the session. The stdin of the session stays
+// open until sudo prompts or the command starts, the output of the login shell
+// may come first.
+type sudoFilter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	stdin io.WriteCloser
+	// input is copied to the stdin once the command started
+	input    io.Reader
+	password []byte
+	prompt   []byte
+	// started is the line printed by the command before it runs, it's
+	// cleared once it was seen
+	started []byte
+	// pending holds the end of the output that may be the start of a prompt
+	pending  []byte
+	prompts  int
+	required bool
+}
+
+func (f *sudoFilter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if bytes.Contains(p, sudoPasswordRequired) {
+		f.required = true
+	}
+	if len(f.prompt) == 0 {
+		return f.w.Write(p)
+	}
+
+	data := append(f.pending, p...)
+	f.pending = nil
+	for {
+		i, marker := f.nextMarker(data)
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			if _, err := f.w.Write(data[:i]); err != nil {
+				return 0, err
+			}
+		}
+		data = data[i+len(marker):]
+		if bytes.Equal(marker, f.prompt) {
+			f.prompted()
+			continue
+		}
+		// sudo no longer reads the password, the command reads its
+		// input or EOF as it would without sudo
+		f.started = nil
+		f.writeInput()
+	}
+	keep := partialPrefix(data, f.prompt)
+	if n := partialPrefix(data, f.started); n > keep {
+		keep = n
+	}
+	if n := len(data) - keep; n > 0 {
+		if _, err := f.w.Write(data[:n]); err != nil {
+			return 0, err
+		}
+	}
+	f.pending = append([]byte(nil), data[len(data)-keep:]...)
+	return len(p), nil
+}
+
+// nextMarker returns the index of the first prompt or start of the command in
+// data and which of them was found, -1 when there is none.
+func (f *sudoFilter) nextMarker(data []byte) (int, []byte) {
+	i, marker := bytes.Index(data, f.prompt), f.prompt
+	if len(f.started) > 0 {
+		if j := bytes.Index(data, f.started); j >= 0 && (i < 0 || j < i) {
+			i, marker = j, f.started
+		}
+	}
+	return i, marker
+}
+
+// prompted answers the first prompt with the password and closes the stdin so
+// that the command reads EOF as it would without sudo. With an input, the stdin is
+// kept open until the command started. Sudo prompts again only when the password
+// is incorrect and then fails on the closed stdin.
+func (f *sudoFilter) prompted() {
+	f.prompts++
+	if f.stdin == nil {
+		return
+	}
+	if f.prompts > 1 {
+		f.closeStdin()
+		return
+	}
+	f.stdin.Write(append(append([]byte(nil), f.password...), '\n'))
+	if f.input == nil {
+		f.closeStdin()
+	}
+}
+
+// writeInput copies the input to the stdin in the background, so that the output
+// is still read when the command does not read all of it, and then closes the stdin.
+func (f *sudoFilter) writeInput() {
+	if f.stdin == nil || f.input == nil {
+		f.closeStdin()
+		return
+	}
+	stdin, input := f.stdin, f.input
+	f.stdin, f.input = nil, nil
+	go func() {
+		io.Copy(stdin, input)
+		stdin.Close()
+	}()
+}
+
+// closeStdin closes the stdin of the session once, when sudo was answered or
+// the command started without prompting for the password.
+func (f *sudoFilter) closeStdin() {
+	if f.stdin != nil {
+		f.stdin.Close()
+		f.stdin = nil
+	}
+}
+
+// result returns the error of the command, replacing it with a distinct
+// error when sudo failed because of the password.
+func (f *sudoFilter) result(err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case f.prompts > 1:
+		return errIncorrectSudoPassword
+	case err != nil && f.required:
+		return errSudoPasswordRequired
+	}
+	return err
+}
+
+// partialPrefix returns the length of the longest suffix of data that is a prefix of prompt.
+func partialPrefix(data, prompt []byte) int {
+	n := len(prompt) - 1
+	if n > len(data) {
+		n = len(data)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasPrefix(prompt, data[len(data)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
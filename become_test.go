@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *nopWriteCloser) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestSudoFilter(t *testing.T) {
+	var (
+		out   bytes.Buffer
+		stdin = &nopWriteCloser{}
+		f     = &sudoFilter{
+			w:        &out,
+			stdin:    stdin,
+			password: []byte("secret"),
+			prompt:   []byte("[slex-sudo-1234]"),
+		}
+	)
+
+	// The prompt is split across writes like the output of a channel can be.
+	for _, p := range []string{"[slex-", "sudo-12", "34]after\n", "[slex-x\n"} {
+		if _, err := f.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out.String() != "after\n[slex-x\n" {
+		t.Errorf("prompt is not removed from the output: %q", out.String())
+	}
+	if stdin.String() != "secret\n" || !stdin.closed {
+		t.Errorf("password is not written once to the closed stdin: %q", stdin.String())
+	}
+	if err := f.result(nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	f.Write([]byte("Sorry, try again.\n[slex-sudo-1234]"))
+	if err := f.result(nil); err != errIncorrectSudoPassword {
+		t.Errorf("expected incorrect password error, got %v", err)
+	}
+	if stdin.String() != "secret\n" {
+		t.Errorf("password is written more than once: %q", stdin.String())
+	}
+}
+
+func TestSudoFilterNoPrompt(t *testing.T) {
+	var (
+		out   bytes.Buffer
+		stdin = &nopWriteCloser{}
+		f     = &sudoFilter{
+			w:        &out,
+			stdin:    stdin,
+			password: []byte("secret"),
+			prompt:   []byte("[slex-sudo-1234]"),
+			started:  []byte("[slex-started-1234]\n"),
+		}
+	)
+
+	// the output of the login shell does not close the stdin
+	f.Write([]byte("Welcome to web1\n[slex"))
+	if stdin.closed {
+		t.Fatal("stdin is closed before sudo prompted or the command started")
+	}
+	// sudo does not prompt when the password is cached or not required
+	f.Write([]byte("-started-12"))
+	f.Write([]byte("34]\nuid=0(root)\n"))
+	if stdin.String() != "" || !stdin.closed {
+		t.Errorf("expected stdin to be closed without the password, got %q", stdin.String())
+	}
+	if out.String() != "Welcome to web1\nuid=0(root)\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestSudoFilterOutputBeforePrompt(t *testing.T) {
+	var (
+		out   bytes.Buffer
+		stdin = &nopWriteCloser{}
+		f     = &sudoFilter{
+			w:        &out,
+			stdin:    stdin,
+			password: []byte("secret"),
+			prompt:   []byte("[slex-sudo-1234]"),
+			started:  []byte("[slex-started-1234]\n"),
+		}
+	)
+
+	for _, p := range []string{"Last login: Mon\n", "[slex-sudo-1234]", "[slex-started-1234]\nok\n"} {
+		f.Write([]byte(p))
+	}
+	if stdin.String() != "secret\n" || !stdin.closed {
+		t.Errorf("expected the password to be written after the output of the login shell, got %q", stdin.String())
+	}
+	if out.String() != "Last login: Mon\nok\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if err := f.result(nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSudoFilterInput(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output []string
+		stdin  string
+	}{
+		{
+			name:   "after the password",
+			output: []string{"[slex-sudo-1234]", "[slex-started-1234]\n"},
+			stdin:  "secret\nkeys\n",
+		},
+		{
+			name:   "without password",
+			output: []string{"[slex-started-1234]\n"},
+			stdin:  "keys\n",
+		},
+		{
+			name:   "incorrect password",
+			output: []string{"[slex-sudo-1234]", "Sorry, try again.\n[slex-sudo-1234]"},
+			stdin:  "secret\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, w := io.Pipe()
+			stdin := make(chan string, 1)
+			go func() {
+				data, _ := ioutil.ReadAll(r)
+				stdin <- string(data)
+			}()
+			f := &sudoFilter{
+				w:        ioutil.Discard,
+				stdin:    w,
+				input:    strings.NewReader("keys\n"),
+				password: []byte("secret"),
+				prompt:   []byte("[slex-sudo-1234]"),
+				started:  []byte("[slex-started-1234]\n"),
+			}
+			for _, p := range tc.output {
+				f.Write([]byte(p))
+			}
+			select {
+			case got := <-stdin:
+				if got != tc.stdin {
+					t.Errorf("expected the stdin %q, got %q", tc.stdin, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the stdin to be closed")
+			}
+		})
+	}
+}
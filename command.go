@@ -16,11 +16,22 @@ func newCommand(context *cli.Context) (c command, err error) {
 		cmd  string
 		args = []string(context.Args())
 	)
+	steps, err := loadSteps(context)
+	if err != nil {
+		return c, err
+	}
 
-	switch len(args) {
-	default:
+	switch {
+	case len(steps) > 0:
+		if len(args) > 0 {
+			return c, fmt.Errorf("a command cannot be specified with --cmd or --cmd-file")
+		}
+		if context.GlobalString("attach") != "" {
+			return c, fmt.Errorf("the local terminal cannot be attached to a host with --cmd or --cmd-file")
+		}
+	case len(args) > 0:
 		cmd = strings.Join(args, " ")
-	case 0:
+	default:
 		raw, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			return c, err
@@ -28,19 +39,57 @@ func newCommand(context *cli.Context) (c command, err error) {
 		cmd = string(raw)
 	}
 
-	if cmd == "" {
+	if cmd == "" && len(steps) == 0 {
 		return c, fmt.Errorf("no command specified")
 	}
 	env, err := parseEnvironment(context)
 	if err != nil {
 		return c, err
 	}
-	return command{
+	// stdin is streamed to the hosts only when it's not read as the command
+	var stdin *stdinSource
+	if len(args) > 0 || len(steps) > 0 {
+		if stdin, err = newStdinSource(context); err != nil {
+			return c, err
+		}
+		// the spool file is removed when the flags are rejected below
+		defer func() {
+			if err != nil && stdin != nil {
+				stdin.Close()
+			}
+		}()
+	} else if context.GlobalBool("stdin") {
+		return c, fmt.Errorf("stdin cannot be streamed when the command is read from it")
+	}
+	if context.GlobalBool("stdin") && context.GlobalString("attach") != "" {
+		return c, fmt.Errorf("stdin cannot be streamed when attached to a host")
+	}
+	if context.GlobalBool("tui") && (context.GlobalBool("stdin") || context.GlobalString("attach") != "") {
+		return c, fmt.Errorf("the local terminal is used by the terminal UI, it can't be streamed to the hosts or attached to a host")
+	}
+	become, err := newBecome(context)
+	if err != nil {
+		return c, err
+	}
+	if become != nil && become.password != nil && stdin != nil {
+		return c, fmt.Errorf("stdin cannot be streamed or read from --stdin-file when the sudo password is written to it")
+	}
+	c = command{
 		Cmd:      cmd,
 		User:     context.GlobalString("user"),
 		Identity: context.GlobalString("identity"),
 		Env:      env,
-	}, nil
+		Stdin:    stdin,
+		Become:   become,
+		Steps:    steps,
+		Template: context.GlobalBool("template"),
+	}
+	if c.Template {
+		if err := c.parseTemplates(); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
 }
 
 func parseEnvironment(context *cli.Context) (map[string]string, error) {
@@ -69,9 +118,31 @@ type command struct {
 
 	// Env are environment variables to pass to the SSH command
 	Env map[string]string
+
+	// Stdin provides the stdin of the SSH command on each host,
+	// it's nil when the command has no stdin
+	Stdin *stdinSource
+
+	// Become executes the SSH command with sudo when it's set
+	Become *become
+
+	// Steps are commands executed in order over the same connection
+	// instead of Cmd when they are set
+	Steps []string
+
+	// Template renders Cmd and Steps for each host as Go templates
+	Template bool
 }
 
 // String returns a pretty printed string of the command
 func (c command) String() string {
+	if len(c.Steps) > 0 {
+		return fmt.Sprintf("user: %s steps: %q", c.User, c.Steps)
+	}
 	return fmt.Sprintf("user: %s command: %s", c.User, c.Cmd)
 }
+
+// shellQuote quotes s so that it's passed as a single word to the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// diffContext is the number of unchanged lines around the changes of a hunk.
+const diffContext = 3
+
+// maxDiffEdits bounds the work of diffLines, outputs with more differences
+// are shown as all the lines removed and all the lines added.
+const maxDiffEdits = 1000
+
+// diffLine is a line of an edit script, kept, removed or added.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines returns the shortest edit script turning a into b with the
+// algorithm of Myers.
+func diffLines(a, b []string) []diffLine {
+	// the common prefix and suffix are kept without searching
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var script []diffLine
+	for _, l := range a[:prefix] {
+		script = append(script, diffLine{' ', l})
+	}
+	script = append(script, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, l := range a[len(a)-suffix:] {
+		script = append(script, diffLine{' ', l})
+	}
+	return script
+}
+
+// myers returns the edit script turning a into b, they can't start or end with the same line.
+func myers(a, b []string) []diffLine {
+	n, m := len(a), len(b)
+	replace := func() []diffLine {
+		var script []diffLine
+		for _, l := range a {
+			script = append(script, diffLine{'-', l})
+		}
+		for _, l := range b {
+			script = append(script, diffLine{'+', l})
+		}
+		return script
+	}
+	if n == 0 || m == 0 {
+		return replace()
+	}
+
+	// trace[d][k+d] is the furthest x reached on diagonal k with d edits
+	var trace [][]int
+	prev := []int{0}
+	found := false
+	for d := 0; d <= n+m && d <= maxDiffEdits; d++ {
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			switch {
+			case d == 0:
+				x = 0
+			case k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]):
+				// insertion from diagonal k+1
+				x = prev[k+1+d-1]
+			default:
+				// deletion from diagonal k-1
+				x = prev[k-1+d-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+d] = x
+			if x >= n && y >= m {
+				found = true
+			}
+		}
+		trace = append(trace, v)
+		prev = v
+		if found {
+			break
+		}
+	}
+	if !found {
+		return replace()
+	}
+
+	// walk back from the end to the start through the trace
+	var reversed []diffLine
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffLine{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, diffLine{'+', b[y]})
+		} else {
+			x--
+			reversed = append(reversed, diffLine{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, diffLine{' ', a[x]})
+	}
+
+	script := make([]diffLine, len(reversed))
+	for i, l := range reversed {
+		script[len(reversed)-1-i] = l
+	}
+	return script
+}
+
+// unifiedDiff writes the differences turning a into b in the unified format
+// and returns whether they differ.
+func unifiedDiff(w io.Writer, nameA, nameB string, a, b []string) bool {
+	script := diffLines(a, b)
+
+	// the hunks are the changes with their context, merged when they overlap
+	type hunk struct{ start, end int }
+	var hunks []hunk
+	for i, l := range script {
+		if l.op == ' ' {
+			continue
+		}
+		start, end := i-diffContext, i+1+diffContext
+		if start < 0 {
+			start = 0
+		}
+		if end > len(script) {
+			end = len(script)
+		}
+		if n := len(hunks); n > 0 && start <= hunks[n-1].end {
+			hunks[n-1].end = end
+			continue
+		}
+		hunks = append(hunks, hunk{start, end})
+	}
+	if len(hunks) == 0 {
+		return false
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	// lineA and lineB are the lines of a and b before the current line of the script
+	var lineA, lineB, i int
+	for _, h := range hunks {
+		for ; i < h.start; i++ {
+			lineA++
+			lineB++
+		}
+		var countA, countB int
+		for _, l := range script[h.start:h.end] {
+			if l.op != '+' {
+				countA++
+			}
+			if l.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(lineA, countA), hunkRange(lineB, countB))
+		for ; i < h.end; i++ {
+			l := script[i]
+			fmt.Fprintf(w, "%c%s\n", l.op, l.text)
+			if l.op != '+' {
+				lineA++
+			}
+			if l.op != '-' {
+				lineB++
+			}
+		}
+	}
+	return true
+}
+
+// hunkRange returns the range of a hunk of count lines after the line before.
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
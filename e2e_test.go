@@ -0,0 +1,935 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// TestMain runs the test binary as slex when it's executed by testCLI.run so that the
+// end to end tests exercise the actual command line against in-process servers.
+func TestMain(m *testing.M) {
+	switch os.Getenv("SLEX_TEST_MAIN") {
+	case "1":
+		main()
+		os.Exit(0)
+	case "nc":
+		// a ProxyCommand connecting its stdin and stdout to the address
+		os.Exit(netcat(os.Args[1]))
+	}
+	os.Exit(m.Run())
+}
+
+func netcat(addr string) int {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// the command exits as soon as one of the directions ends
+	go func() {
+		io.Copy(c, os.Stdin)
+		c.Close()
+	}()
+	io.Copy(os.Stdout, c)
+	return 0
+}
+
+// testCLI runs slex authenticating with its own key, its own directory is the
+// home directory so that the ssh config, the keys and the state of the user
+// running the tests are not used.
+type testCLI struct {
+	dir      string
+	identity string
+	key      ssh.PublicKey
+}
+
+func newCLI(t *testing.T) *testCLI {
+	dir := t.TempDir()
+	identity := filepath.Join(dir, "id_ecdsa")
+	key, err := sshtest.WriteKey(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCLI{dir: dir, identity: identity, key: key}
+}
+
+// run executes slex with the arguments and returns its output, slex must succeed.
+func (c *testCLI) run(t *testing.T, args ...string) string {
+	out, err := c.exec(args...)
+	if err != nil {
+		t.Fatalf("slex %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+// exec executes slex with the arguments and returns its output and exit error.
+func (c *testCLI) exec(args ...string) (string, error) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 30*time.Second)
+	defer cancel()
+
+	out, err := c.command(ctx, args...).CombinedOutput()
+	return string(out), err
+}
+
+// start executes slex with the arguments in the background, its output is
+// written to the returned buffer.
+func (c *testCLI) start(t *testing.T, args ...string) (*exec.Cmd, *bytes.Buffer) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	var out bytes.Buffer
+	cmd := c.command(ctx, args...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, &out
+}
+
+func (c *testCLI) command(ctx gocontext.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], append([]string{"-i", c.identity}, args...)...)
+	cmd.Env = []string{
+		"SLEX_TEST_MAIN=1",
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + c.dir,
+		"XDG_STATE_HOME=" + c.dir,
+	}
+	return cmd
+}
+
+func newServers(t *testing.T, n int, config sshtest.Config) ([]*sshtest.Server, []string) {
+	servers, err := sshtest.NewServers(n, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args []string
+	for _, s := range servers {
+		s := s
+		t.Cleanup(func() { s.Close() })
+		args = append(args, "--host", s.Addr())
+	}
+	return servers, args
+}
+
+// expectHost fails when the last status of the host in the output is not the expected one.
+func expectHost(t *testing.T, out, host, status string) {
+	t.Helper()
+	// errors can contain the address, the status line starts with the host underlined
+	prefix := underline + host + ": "
+	i := strings.LastIndex(out, prefix)
+	if i < 0 {
+		t.Errorf("no status for %s in output:\n%s", host, out)
+		return
+	}
+	if line := out[i+len(prefix):]; !strings.HasPrefix(line, status) {
+		t.Errorf("expected %s: %s, got %s: %s", host, status, host, strings.SplitN(line, "\n", 2)[0])
+	}
+}
+
+func TestCLIRun(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 3, sshtest.Config{AuthorizedKeys: []ssh.PublicKey{c.key}})
+
+	args := append(hosts, "-e", "GREETING=hello", "echo $GREETING from $USER")
+	out := c.run(t, args...)
+	for _, s := range servers {
+		expectHost(t, out, s.Addr(), "FINISHED")
+		if cmds := s.Commands(); len(cmds) != 1 || cmds[0] != "echo $GREETING from $USER" {
+			t.Errorf("unexpected commands on %s: %v", s.Addr(), cmds)
+		}
+	}
+	if !strings.Contains(out, "hello from") {
+		t.Errorf("expected the output of the command, got:\n%s", out)
+	}
+}
+
+func TestCLIFailures(t *testing.T) {
+	c := newCLI(t)
+	exitCodes := map[string]int{"ok": 0, "fail": 2, "drop": -1}
+	handler := func(e *sshtest.Exec) int {
+		return exitCodes[e.Command]
+	}
+	_, hosts := newServers(t, 1, sshtest.Config{AuthorizedKeys: []ssh.PublicKey{c.key}, Handler: handler})
+	_, denied := newServers(t, 1, sshtest.Config{AuthorizedKeys: []ssh.PublicKey{newCLI(t).key}})
+	_, refused := newServers(t, 1, sshtest.Config{Refuse: true})
+
+	out := c.run(t, append(append(append([]string{}, hosts...), denied...), append(refused, "ok")...)...)
+	expectHost(t, out, hosts[1], "FINISHED")
+	expectHost(t, out, denied[1], "ERROR none of the provided authentication methods")
+	expectHost(t, out, refused[1], "ERROR none of the provided authentication methods")
+
+	out = c.run(t, append(hosts, "fail")...)
+	expectHost(t, out, hosts[1], "ERROR Process exited with status 2")
+
+	out = c.run(t, append(hosts, "drop")...)
+	expectHost(t, out, hosts[1], "ERROR wait: remote command exited without exit status")
+}
+
+func TestCLIConcurrency(t *testing.T) {
+	c := newCLI(t)
+	var (
+		mu              sync.Mutex
+		running, maxRun int
+	)
+	handler := func(e *sshtest.Exec) int {
+		mu.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 0
+	}
+	servers, hosts := newServers(t, 6, sshtest.Config{Handler: handler})
+
+	out := c.run(t, append(hosts, "-c", "2", "true")...)
+	for _, s := range servers {
+		expectHost(t, out, s.Addr(), "FINISHED")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxRun != 2 {
+		t.Errorf("expected 2 commands to run at once, got %d", maxRun)
+	}
+}
+
+func TestCLIProxyJump(t *testing.T) {
+	c := newCLI(t)
+	jumps, _ := newServers(t, 1, sshtest.Config{Forwarding: true})
+	servers, hosts := newServers(t, 1, sshtest.Config{})
+	out := c.run(t, append(hosts, "-o", fmt.Sprintf("ProxyJump=%s", jumps[0].Addr()), "uptime")...)
+	expectHost(t, out, servers[0].Addr(), "FINISHED")
+	if cmds := servers[0].Commands(); len(cmds) != 1 {
+		t.Errorf("expected the command on the target, got %v", cmds)
+	}
+	if cmds := jumps[0].Commands(); len(cmds) != 0 {
+		t.Errorf("expected no commands on the jump host, got %v", cmds)
+	}
+
+	jumps[0].Close()
+	out = c.run(t, append(hosts, "-o", fmt.Sprintf("ProxyJump=%s", jumps[0].Addr()), "uptime")...)
+	expectHost(t, out, servers[0].Addr(), "ERROR")
+}
+
+func TestCLIProxy(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 1, sshtest.Config{})
+	proxy, err := sshtest.NewSOCKS5Proxy("slex", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+
+	out := c.run(t, append(hosts, "--no-stdin", "--proxy", "socks5h://slex:secret@"+proxy.Addr(), "uptime")...)
+	expectHost(t, out, servers[0].Addr(), "FINISHED")
+	if targets := proxy.Targets(); len(targets) != 1 || targets[0] != servers[0].Addr() {
+		t.Errorf("expected the connection to go through the proxy, got %v", targets)
+	}
+	out = c.run(t, append(hosts, "--no-stdin", "--proxy", "socks5h://slex:wrong@"+proxy.Addr(), "uptime")...)
+	expectHost(t, out, servers[0].Addr(), "ERROR")
+	if !strings.Contains(out, "proxy "+proxy.Addr()+": socks authentication failed") {
+		t.Errorf("expected the proxy to reject the password, got:\n%s", out)
+	}
+
+	proxyCommand := fmt.Sprintf("ProxyCommand=env SLEX_TEST_MAIN=nc %s %%h:%%p", os.Args[0])
+	out = c.run(t, append(hosts, "--no-stdin", "-o", proxyCommand, "uptime")...)
+	expectHost(t, out, servers[0].Addr(), "FINISHED")
+	if cmds := servers[0].Commands(); len(cmds) != 2 {
+		t.Errorf("expected the command through the ProxyCommand, got %v", cmds)
+	}
+}
+
+func TestCLITunnel(t *testing.T) {
+	c := newCLI(t)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello\n"))
+			conn.Close()
+		}
+	}()
+	_, hosts := newServers(t, 1, sshtest.Config{Forwarding: true})
+	local := net.JoinHostPort("127.0.0.1", freePort(t))
+
+	cmd, out := c.start(t, append(hosts, "-L", local+":"+target.Addr().String(), "tunnel")...)
+	var greeting []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		conn, err := net.Dial("tcp", local)
+		if err != nil {
+			continue
+		}
+		greeting, _ = ioutil.ReadAll(conn)
+		conn.Close()
+		break
+	}
+	if string(greeting) != "hello\n" {
+		t.Errorf("expected the target through the forward, got %q", greeting)
+	}
+	// the forwards are up until interrupted
+	cmd.Process.Signal(os.Interrupt)
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("slex tunnel: %v\n%s", err, out)
+	}
+	if !strings.Contains(out.String(), "L "+local+" -> "+target.Addr().String()) {
+		t.Errorf("expected the forward in the output, got:\n%s", out)
+	}
+}
+
+// freePort returns a port of localhost that was free when it was called.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestCLITemplate(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 2, sshtest.Config{})
+
+	// the plan is printed without connecting to the hosts
+	out := c.run(t, append(hosts, "--no-stdin", "--template", "--dry-run", "echo {{.Index}} {{.Port}}")...)
+	for i, s := range servers {
+		_, port, _ := net.SplitHostPort(s.Addr())
+		if !regexp.MustCompile(fmt.Sprintf(`command\s+echo %d %s\s*\n`, i, port)).MatchString(out) {
+			t.Errorf("expected the rendered command of %s in the plan, got:\n%s", s.Addr(), out)
+		}
+		if cmds := s.Commands(); len(cmds) != 0 {
+			t.Errorf("expected no commands on %s with --dry-run, got %v", s.Addr(), cmds)
+		}
+	}
+
+	out = c.run(t, append(hosts, "--no-stdin", "--template", "echo {{.Index}} {{.Port}}")...)
+	for i, s := range servers {
+		_, port, _ := net.SplitHostPort(s.Addr())
+		expectHost(t, out, s.Addr(), "FINISHED")
+		if cmds := s.Commands(); len(cmds) != 1 || cmds[0] != fmt.Sprintf("echo %d %s", i, port) {
+			t.Errorf("expected the rendered command on %s, got %v", s.Addr(), cmds)
+		}
+	}
+
+	out = c.run(t, append(hosts, "--no-stdin", "--template", "echo {{.Vars.missing}}")...)
+	expectHost(t, out, servers[0].Addr(), "ERROR")
+	if out, err := c.exec(append(hosts, "--no-stdin", "--template", "echo {{.Host")...); err == nil {
+		t.Errorf("expected the invalid template to be rejected, got:\n%s", out)
+	}
+}
+
+func TestCLIBecome(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 1, sshtest.Config{Handler: func(e *sshtest.Exec) int {
+		if strings.Contains(e.Command, "restricted") {
+			fmt.Fprintln(e.Stderr, "sudo: a password is required")
+			return 1
+		}
+		return 0
+	}})
+
+	out := c.run(t, append(hosts, "--no-stdin", "-b", "--become-user", "postgres", "psql")...)
+	expectHost(t, out, servers[0].Addr(), "FINISHED")
+	expected := (&become{user: "postgres"}).wrap("psql", false)
+	if cmds := servers[0].Commands(); len(cmds) != 1 || cmds[0] != expected {
+		t.Errorf("expected %s, got %v", expected, cmds)
+	}
+
+	out = c.run(t, append(hosts, "--no-stdin", "-b", "restricted")...)
+	expectHost(t, out, servers[0].Addr(), "ERROR "+errSudoPasswordRequired.Error())
+}
+
+func TestCLIPut(t *testing.T) {
+	for _, sftp := range []bool{true, false} {
+		sftp := sftp
+		t.Run(fmt.Sprintf("sftp=%t", sftp), func(t *testing.T) {
+			if _, err := exec.LookPath("scp"); err != nil && !sftp {
+				t.Skip("scp is not installed")
+			}
+			c := newCLI(t)
+			_, hosts := newServers(t, 1, sshtest.Config{SFTP: sftp})
+			local := filepath.Join(c.dir, "app.conf")
+			if err := ioutil.WriteFile(local, []byte("listen 80\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// the setuid bit is kept when the owner is changed
+			if err := os.Chmod(local, 0755|os.ModeSetuid); err != nil {
+				t.Fatal(err)
+			}
+			remote := filepath.Join(c.dir, "remote")
+			if err := os.Mkdir(remote, 0755); err != nil {
+				t.Fatal(err)
+			}
+			target := filepath.Join(remote, "app.conf")
+			if err := ioutil.WriteFile(target, []byte("previous\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			expectRemote := func() {
+				t.Helper()
+				info, err := os.Stat(target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if content := mustRead(t, target); content != "listen 80\n" {
+					t.Errorf("expected the uploaded content, got %q", content)
+				}
+				// the sftp server of the tests drops the setuid bit on chmod
+				mode := info.Mode()
+				if sftp {
+					mode |= os.ModeSetuid
+				}
+				if mode != 0755|os.ModeSetuid {
+					t.Errorf("expected the mode of the local file, got %s", info.Mode())
+				}
+				temps, _ := filepath.Glob(filepath.Join(remote, ".*.slex-*"))
+				if len(temps) != 0 {
+					t.Errorf("expected no temporary files, got %v", temps)
+				}
+			}
+
+			owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+			out := c.run(t, append(hosts, "put", "--owner", owner, local, remote)...)
+			expectHost(t, out, hosts[1], "FINISHED")
+			expectRemote()
+
+			// the file is left unchanged when the upload fails
+			out = c.run(t, append(hosts, "put", "--owner", "slex-no-such-user", local, target)...)
+			expectHost(t, out, hosts[1], "ERROR")
+			expectRemote()
+		})
+	}
+}
+
+func TestCLIGet(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 1, sshtest.Config{SFTP: true})
+	_, port, _ := net.SplitHostPort(servers[0].Addr())
+	remote := filepath.Join(c.dir, "logs")
+	for name, content := range map[string]string{
+		"app.log":       "started\n",
+		"db.log":        "connected\n",
+		"archive/0.log": "rotated\n",
+		"notes.txt":     "not a log\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(remote, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(remote, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local := filepath.Join(c.dir, "default")
+	out := c.run(t, append(hosts, "get", filepath.Join(remote, "*.log"), local)...)
+	expectHost(t, out, hosts[1], "FINISHED")
+	for name, content := range map[string]string{"app.log": "started\n", "db.log": "connected\n"} {
+		if got := mustRead(t, filepath.Join(local, hosts[1], name)); got != content {
+			t.Errorf("expected %q in %s, got %q", content, name, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(local, hosts[1], "notes.txt")); err == nil {
+		t.Error("expected the files not matching the glob to be skipped")
+	}
+
+	// the matched directories are downloaded with their content
+	local = filepath.Join(c.dir, "named")
+	c.run(t, append(hosts, "get", "--gzip", "--name-template", "{{.Port}}/{{.Path}}", filepath.Join(remote, "archive"), local)...)
+	f, err := os.Open(filepath.Join(local, port, "archive", "0.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(gz); err != nil || string(data) != "rotated\n" {
+		t.Errorf("expected the compressed file, got %q - %v", data, err)
+	}
+
+	out = c.run(t, append(hosts, "get", "--name-template", "../{{.Base}}", filepath.Join(remote, "app.log"), local)...)
+	expectHost(t, out, hosts[1], "ERROR ../app.log is outside of "+local)
+
+	// the files are downloaded until the limit is reached
+	local = filepath.Join(c.dir, "limited")
+	out = c.run(t, append(hosts, "get", "--max-size", "12", "--name-template", "{{.Base}}", filepath.Join(remote, "*.log"), local)...)
+	expectHost(t, out, hosts[1], "ERROR size limit of 12B exceeded")
+	if files, _ := ioutil.ReadDir(local); len(files) != 1 {
+		t.Errorf("expected only the first file and no temporary files, got %d files", len(files))
+	}
+}
+
+func TestCLIScript(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 1, sshtest.Config{SFTP: true})
+	remote := filepath.Join(c.dir, "remote")
+	if err := os.Mkdir(remote, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(c.dir, "deploy.sh")
+	expectRemoved := func() {
+		t.Helper()
+		if files, _ := ioutil.ReadDir(remote); len(files) != 0 {
+			t.Errorf("expected the script to be removed, got %s", files[0].Name())
+		}
+	}
+
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"deploying $1\"\nexit $2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := c.run(t, append(hosts, "script", "--remote-dir", remote, script, "v1.2 beta", "0")...)
+	expectHost(t, out, servers[0].Addr(), "FINISHED")
+	if !strings.Contains(out, "deploying v1.2 beta") {
+		t.Errorf("expected the output of the script, got:\n%s", out)
+	}
+	expectRemoved()
+
+	out = c.run(t, append(hosts, "script", "--remote-dir", remote, script, "v1.3", "3")...)
+	expectHost(t, out, servers[0].Addr(), "ERROR Process exited with status 3")
+	expectRemoved()
+
+	// the script is terminated when slex is interrupted
+	started, terminated := filepath.Join(c.dir, "started"), filepath.Join(c.dir, "terminated")
+	long := fmt.Sprintf("trap 'kill $pid; touch %s; exit 143' TERM\nsleep 30 &\npid=$!\ntouch %s\nwait\n", terminated, started)
+	if err := ioutil.WriteFile(script, []byte(long), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd, output := c.start(t, append(hosts, "script", "--remote-dir", remote, script)...)
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+	}
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+	if _, err := os.Stat(terminated); err != nil {
+		t.Errorf("expected the script to be terminated, got:\n%s", output)
+	}
+	expectRemoved()
+}
+
+func TestCLIRerun(t *testing.T) {
+	c := newCLI(t)
+	var (
+		mu      sync.Mutex
+		failing = true
+	)
+	handler := func(e *sshtest.Exec) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return 1
+		}
+		return 0
+	}
+	ok, okHosts := newServers(t, 1, sshtest.Config{})
+	failed, failedHosts := newServers(t, 1, sshtest.Config{Handler: handler})
+	_, unreached := newServers(t, 1, sshtest.Config{Refuse: true})
+
+	c.run(t, append(append(append(okHosts, failedHosts...), unreached...), "true")...)
+	// the subcommands do not replace the last run of the commands
+	c.exec(append(okHosts, "get", "/nonexistent", c.dir)...)
+	if _, err := os.Stat(filepath.Join(c.dir, "slex", "last-get-run.json")); err != nil {
+		t.Errorf("expected the last run of get to be saved - %v", err)
+	}
+
+	// the hosts of the previous run are not mixed with the hosts given again
+	if out, err := c.exec(append(okHosts, "--rerun-failed", "true")...); err == nil || !strings.Contains(out, "can't be used") {
+		t.Errorf("expected the hosts to be rejected with --rerun-failed, got %v:\n%s", err, out)
+	}
+
+	out := c.run(t, "--rerun-failed", "true")
+	expectHost(t, out, failedHosts[1], "ERROR Process exited with status 1")
+	if strings.Contains(out, okHosts[1]) || strings.Contains(out, unreached[1]) {
+		t.Errorf("expected only the failed host to run again, got:\n%s", out)
+	}
+	if cmds := ok[0].Commands(); len(cmds) != 1 {
+		t.Errorf("expected the command once on the host that succeeded, got %v", cmds)
+	}
+	if cmds := failed[0].Commands(); len(cmds) != 2 {
+		t.Errorf("expected the command twice on the host that failed, got %v", cmds)
+	}
+
+	// the unreached host of the first run is kept in the state of the rerun
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	out = c.run(t, "--rerun-failed", "--rerun-unreached", "true")
+	expectHost(t, out, failedHosts[1], "FINISHED")
+	expectHost(t, out, unreached[1], "ERROR")
+	if cmds := failed[0].Commands(); len(cmds) != 3 {
+		t.Errorf("expected the command on the host that failed again, got %v", cmds)
+	}
+}
+
+func TestCLIPing(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 3, sshtest.Config{Handler: func(e *sshtest.Exec) int {
+		t.Errorf("unexpected command %s", e.Command)
+		return 1
+	}})
+	_, refused := newServers(t, 1, sshtest.Config{Refuse: true})
+
+	// the first host is known, the key of the second host changed and the third host is unknown
+	var lines []string
+	for i, s := range servers[:2] {
+		key := s.HostKey()
+		if i == 1 {
+			key = servers[2].HostKey()
+		}
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, key))
+	}
+	known := filepath.Join(c.dir, "known_hosts")
+	if err := ioutil.WriteFile(known, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := c.run(t, append(hosts, "ping", "--known-hosts", known)...)
+	for i, status := range []string{hostKeyKnown, hostKeyChanged, hostKeyUnknown} {
+		line := findLine(out, servers[i].Addr())
+		if !strings.Contains(line, ssh.FingerprintSHA256(servers[i].HostKey())+" "+status) || !strings.HasSuffix(line, "ok") {
+			t.Errorf("expected the host key to be %s, got %s", status, line)
+		}
+	}
+
+	out, err := c.exec(append(append(append([]string{}, hosts[:2]...), refused...), "ping", "--known-hosts", known)...)
+	if err == nil {
+		t.Error("expected ping to fail for the unreachable host")
+	}
+	if line := findLine(out, refused[1]); !strings.Contains(line, "failed at banner") {
+		t.Errorf("expected the host to fail at the banner, got %s", line)
+	}
+}
+
+// findLine returns the first line of the output starting with the prefix.
+func findLine(out, prefix string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
+
+func TestCLIKeyscan(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 2, sshtest.Config{})
+
+	// the known key of the second host changed
+	known := filepath.Join(c.dir, "known_hosts")
+	changed := knownhosts.Line([]string{servers[1].Addr()}, servers[0].HostKey()) + "\n"
+	if err := ioutil.WriteFile(known, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := c.exec(append(hosts, "keyscan", "--hash", "--known-hosts", known)...)
+	if err == nil {
+		t.Errorf("expected keyscan to fail for the changed key, got:\n%s", out)
+	}
+	if line := findLine(out, servers[0].Addr()); !strings.HasSuffix(line, "added") {
+		t.Errorf("expected the key to be added, got %s", line)
+	}
+	if line := findLine(out, servers[1].Addr()); !strings.HasSuffix(line, "CHANGED, not added") {
+		t.Errorf("expected the key to be reported as changed, got %s", line)
+	}
+	data, err := ioutil.ReadFile(known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || lines[0]+"\n" != changed || !strings.HasPrefix(lines[1], "|1|") {
+		t.Fatalf("expected the hashed key of the first host to be added, got:\n%s", data)
+	}
+
+	// the hashed key is known
+	out = c.run(t, hosts[0], hosts[1], "keyscan", "--known-hosts", known)
+	if line := findLine(out, servers[0].Addr()); !strings.HasSuffix(line, "known") {
+		t.Errorf("expected the key to be known, got %s", line)
+	}
+	if after, _ := ioutil.ReadFile(known); string(after) != string(data) {
+		t.Errorf("expected no keys to be added, got:\n%s", after)
+	}
+}
+
+func TestCLIAuthorizedKeys(t *testing.T) {
+	c := newCLI(t)
+	_, hosts := newServers(t, 1, sshtest.Config{})
+	_, locked := newServers(t, 1, sshtest.Config{AuthorizedKeys: []ssh.PublicKey{c.key}})
+
+	newKey, err := sshtest.WriteKey(filepath.Join(c.dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := filepath.Join(c.dir, "new.pub")
+	if err := ioutil.WriteFile(keyfile, append(bytes.TrimSpace(ssh.MarshalAuthorizedKey(newKey)), " new@team\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(c.dir, "authorized_keys")
+	old := `no-pty,from="10.0.0.0/8" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(c.key))) + " old@team\n# team keys\n"
+	if err := ioutil.WriteFile(file, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expectFile := func(content string) {
+		t.Helper()
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("expected authorized_keys:\n%s\ngot:\n%s", content, data)
+		}
+	}
+	added := old + strings.TrimSpace(mustRead(t, keyfile)) + "\n"
+
+	out := c.run(t, append(hosts, "authorized-keys", "add", "--file", file, keyfile)...)
+	expectFile(added)
+	if !strings.Contains(out, "+ "+newKey.Type()+" "+ssh.FingerprintSHA256(newKey)+" new@team") {
+		t.Errorf("expected the added key in the output, got:\n%s", out)
+	}
+	out = c.run(t, append(hosts, "authorized-keys", "add", "--file", file, keyfile)...)
+	if !strings.Contains(out, file+" unchanged") {
+		t.Errorf("expected the file to be unchanged, got:\n%s", out)
+	}
+
+	// the new key can't log in so the old key is kept
+	out = c.run(t, append(locked, "authorized-keys", "sync", "--file", file, keyfile)...)
+	expectHost(t, out, locked[1], "ERROR no key can log in")
+	expectFile(added)
+
+	c.run(t, append(hosts, "authorized-keys", "sync", "--file", file, keyfile)...)
+	expectFile("# team keys\n" + strings.TrimSpace(mustRead(t, keyfile)) + "\n")
+	if backup := mustRead(t, file+".bak"); backup != added {
+		t.Errorf("expected the previous file as backup, got:\n%s", backup)
+	}
+
+	c.run(t, append(hosts, "authorized-keys", "remove", "--file", file, keyfile)...)
+	expectFile("# team keys\n")
+
+	// the content is not passed in the arguments of the script, which are limited to 128 KiB
+	large := strings.Repeat("# "+strings.Repeat("x", 78)+"\n", 3*1024)
+	if err := ioutil.WriteFile(file, []byte(large), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.run(t, append(hosts, "authorized-keys", "add", "--file", file, keyfile)...)
+	expectFile(large + strings.TrimSpace(mustRead(t, keyfile)) + "\n")
+
+	// the user of the host is expanded by the shell for a relative file
+	marker := filepath.Join(c.dir, "expanded")
+	out = c.run(t, append(hosts, "-u", "$(touch "+marker+")", "authorized-keys", "add", keyfile)...)
+	expectHost(t, out, hosts[1], "ERROR invalid user name")
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("expected the user not to be expanded")
+	}
+}
+
+func mustRead(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCLIDiff(t *testing.T) {
+	c := newCLI(t)
+	var (
+		mu      sync.Mutex
+		outputs = make([]string, 3)
+		servers []*sshtest.Server
+		hosts   []string
+	)
+	for i := range outputs {
+		i := i
+		s, h := newServers(t, 1, sshtest.Config{Handler: func(e *sshtest.Exec) int {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprint(e.Stdout, outputs[i])
+			return 0
+		}})
+		servers, hosts = append(servers, s[0]), append(hosts, h...)
+	}
+	sysctl := "vm.swappiness = 60\nnet.core.somaxconn = 4096\nkernel.pid_max = 4194304\n"
+	mu.Lock()
+	outputs[0] = sysctl
+	outputs[1] = sysctl
+	outputs[2] = strings.Replace(sysctl, "60", "10", 1)
+	mu.Unlock()
+
+	previous := filepath.Join(c.dir, "previous.json")
+	out := c.run(t, append(hosts, "--no-stdin", "--state", previous, "--save-output", "--diff-against", servers[0].Addr(), "sysctl -a")...)
+	expected := fmt.Sprintf("--- %s\n+++ %s\n@@ -1,3 +1,3 @@\n-vm.swappiness = 60\n+vm.swappiness = 10\n", servers[0].Addr(), servers[2].Addr())
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected the diff of the third host:\n%s\ngot:\n%s", expected, out)
+	}
+	if !strings.Contains(out, fmt.Sprintf("1 hosts match %s: %s\n", servers[0].Addr(), servers[1].Addr())) {
+		t.Errorf("expected the second host to match, got:\n%s", out)
+	}
+
+	if _, err := os.Stat(filepath.Join(c.dir, "previous.output")); err != nil {
+		t.Fatalf("expected the output of the hosts to be saved - %v", err)
+	}
+	mu.Lock()
+	outputs[1] = sysctl + "fs.file-max = 100\n"
+	mu.Unlock()
+	out = c.run(t, append(hosts, "--no-stdin", "--diff-against-run", previous, "sysctl -a")...)
+	if !strings.Contains(out, "@@ -1,3 +1,4 @@\n vm.swappiness = 60\n net.core.somaxconn = 4096\n kernel.pid_max = 4194304\n+fs.file-max = 100\n") {
+		t.Errorf("expected the diff of the second host with its previous output, got:\n%s", out)
+	}
+	if !strings.Contains(out, fmt.Sprintf("2 hosts match the run of %s: %s, %s\n", previous, servers[0].Addr(), servers[2].Addr())) {
+		t.Errorf("expected the other hosts to match their previous output, got:\n%s", out)
+	}
+}
+
+func TestCLISteps(t *testing.T) {
+	c := newCLI(t)
+	_, hosts := newServers(t, 1, sshtest.Config{})
+	input := filepath.Join(c.dir, "input")
+	if err := ioutil.WriteFile(input, []byte("from stdin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stdin is streamed to the first step only
+	out := c.run(t, append(hosts, "--no-stdin", "--stdin-file", hosts[1]+"="+input, "--cmd", "cat", "--cmd", "cat; echo done")...)
+	if !strings.Contains(out, "from stdin\ndone") || strings.Contains(out, "from stdin\nfrom stdin") {
+		t.Errorf("expected the stdin once and both steps to run, got:\n%s", out)
+	}
+
+	if out, err := c.exec(append(hosts, "--attach", hosts[1], "--cmd", "uptime")...); err == nil {
+		t.Errorf("expected --attach to be rejected with steps, got:\n%s", out)
+	}
+}
+
+func TestCLIExpect(t *testing.T) {
+	c := newCLI(t)
+	exitCodes := map[string]int{"active": 0, "degraded": 3, "failed": 3}
+	servers, hosts := newServers(t, 1, sshtest.Config{Handler: func(e *sshtest.Exec) int {
+		fmt.Fprintf(e.Stdout, "Active: %s\n", e.Command)
+		return exitCodes[e.Command]
+	}})
+	addr := servers[0].Addr()
+
+	out := c.run(t, append(hosts, "--no-stdin", "--expect", "^Active: (active|degraded)", "--expect-exit", "0,3", "degraded")...)
+	if !strings.Contains(out, underline+addr+": PASS") || !strings.Contains(out, "1 hosts: 1 PASS, 0 FAIL") {
+		t.Errorf("expected the host to pass, got:\n%s", out)
+	}
+	// the exit status of the step that failed is checked
+	out = c.run(t, append(hosts, "--no-stdin", "--cmd", "active", "--cmd", "degraded", "--expect-exit", "3")...)
+	if !strings.Contains(out, underline+addr+": PASS") {
+		t.Errorf("expected the host to pass with steps, got:\n%s", out)
+	}
+
+	for _, args := range [][]string{
+		{"--expect", "^Active: (active|degraded)", "--expect-exit", "0,3", "failed"},
+		{"--expect-not", "degraded", "--expect-exit", "0,3", "degraded"},
+		{"--expect", "^Active", "degraded"},
+	} {
+		out, err := c.exec(append(append(append([]string{}, hosts...), "--no-stdin"), args...)...)
+		if err == nil {
+			t.Errorf("expected %v to fail, got:\n%s", args, out)
+		}
+		if !strings.Contains(out, underline+addr+": FAIL") || !strings.Contains(out, "1 hosts: 0 PASS, 1 FAIL") {
+			t.Errorf("expected the host to fail with %v, got:\n%s", args, out)
+		}
+	}
+}
+
+func TestCLIRecord(t *testing.T) {
+	c := newCLI(t)
+	servers, hosts := newServers(t, 2, sshtest.Config{Handler: func(e *sshtest.Exec) int {
+		fmt.Fprint(e.Stdout, "deploying\n")
+		fmt.Fprint(e.Stderr, "warning: slow\n")
+		return 0
+	}})
+	hosts = append(hosts, "--host", "127.0.0.1:1")
+	dir := filepath.Join(c.dir, "recording")
+
+	out, err := c.exec(append(hosts, "--no-stdin", "--record", dir, "deploy")...)
+	if err != nil {
+		t.Fatalf("slex: %v\n%s", err, out)
+	}
+	// a second run is recorded next to the first one
+	c.exec(append(hosts, "--no-stdin", "--record", dir, "--expect-not", "deploying", "deploy")...)
+	runs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("expected a directory for each run, got %d", len(runs))
+	}
+	var failed runManifest
+	if err := json.Unmarshal([]byte(mustRead(t, filepath.Join(dir, runs[1].Name(), "manifest.json"))), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if h := failed.Hosts[0]; h.ExitCode == nil || *h.ExitCode != 0 || !strings.Contains(h.Error, "the output matches") {
+		t.Errorf("expected the exit status and the unmet expectation of the host, got %+v", h)
+	}
+
+	dir = filepath.Join(dir, runs[0].Name())
+	var manifest runManifest
+	if err := json.Unmarshal([]byte(mustRead(t, filepath.Join(dir, "manifest.json"))), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Command != "deploy" || manifest.Operator == "" || manifest.Ended.Before(manifest.Started) || len(manifest.Hosts) != 3 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	for i, s := range servers {
+		h := manifest.Hosts[i]
+		if h.Host != s.Addr() || h.ExitCode == nil || *h.ExitCode != 0 || h.Started == nil || h.Ended == nil {
+			t.Errorf("unexpected manifest of %s: %+v", s.Addr(), h)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(mustRead(t, filepath.Join(dir, h.Cast))), "\n")
+		var header castHeader
+		if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Version != 2 || header.Command != "deploy" || header.Title != s.Addr() {
+			t.Errorf("unexpected header of %s: %s", h.Cast, lines[0])
+		}
+		var output string
+		for _, l := range lines[1:] {
+			var event []interface{}
+			if err := json.Unmarshal([]byte(l), &event); err != nil {
+				t.Fatal(err)
+			}
+			output += event[2].(string)
+		}
+		if !strings.Contains(output, "deploying\r\n") || !strings.Contains(output, "warning: slow\r\n") {
+			t.Errorf("expected the output of %s to be recorded, got %q", s.Addr(), output)
+		}
+	}
+	if h := manifest.Hosts[2]; h.ExitCode != nil || !strings.Contains(h.Error, "connection refused") {
+		t.Errorf("expected the unreachable host to have no exit status, got %+v", h)
+	}
+}
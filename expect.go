@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// expectations decide whether the command passed on a host from its
+// output and exit status.
+type expectations struct {
+	match    []*regexp.Regexp
+	notMatch []*regexp.Regexp
+	// exits are the exit statuses that pass, only 0 when empty
+	exits map[int]bool
+}
+
+// newExpectations returns the expectations of the --expect, --expect-not and
+// --expect-exit flags or nil when none is set.
+func newExpectations(context *cli.Context) (*expectations, error) {
+	e := &expectations{}
+	var err error
+	if e.match, err = compileExpressions(context.GlobalStringSlice("expect")); err != nil {
+		return nil, err
+	}
+	if e.notMatch, err = compileExpressions(context.GlobalStringSlice("expect-not")); err != nil {
+		return nil, err
+	}
+	for _, value := range context.GlobalStringSlice("expect-exit") {
+		for _, s := range strings.Split(value, ",") {
+			status, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || status < 0 {
+				return nil, fmt.Errorf("invalid exit status %q in --expect-exit", s)
+			}
+			if e.exits == nil {
+				e.exits = make(map[int]bool)
+			}
+			e.exits[status] = true
+		}
+	}
+	if len(e.match) == 0 && len(e.notMatch) == 0 && e.exits == nil {
+		return nil, nil
+	}
+	if (len(e.match) > 0 || len(e.notMatch) > 0) && context.GlobalBool("quiet") {
+		return nil, fmt.Errorf("the output is checked by --expect and --expect-not, it can't be disabled with --quiet")
+	}
+	return e, nil
+}
+
+// compileExpressions compiles the expressions matching at the start and end of each line with ^ and $.
+func compileExpressions(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile("(?m)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q - %v", expr, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// check returns the error of the command on the host, err, replaced by
+// whether its exit status and output meet the expectations.
+func (e *expectations) check(lines []string, err error) error {
+	status := 0
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) {
+			// the command did not exit
+			return err
+		}
+		status = exitErr.ExitStatus()
+	}
+	switch {
+	case e.exits == nil && status != 0:
+		return err
+	case e.exits != nil && !e.exits[status]:
+		return fmt.Errorf("unexpected exit status %d", status)
+	}
+
+	output := strings.Join(lines, "\n")
+	for _, re := range e.match {
+		if !re.MatchString(output) {
+			return fmt.Errorf("the output does not match %q", expression(re))
+		}
+	}
+	for _, re := range e.notMatch {
+		if re.MatchString(output) {
+			return fmt.Errorf("the output matches %q", expression(re))
+		}
+	}
+	return nil
+}
+
+// expression returns the expression re was compiled from by compileExpressions.
+func expression(re *regexp.Regexp) string {
+	return strings.TrimPrefix(re.String(), "(?m)")
+}
+
+// printAssertions writes the number of hosts that passed and failed and
+// returns the number of hosts that failed.
+func printAssertions(w io.Writer, jobs []*job) int {
+	var failed []string
+	for _, j := range jobs {
+		if j.err != nil {
+			failed = append(failed, j.name)
+		}
+	}
+	fmt.Fprintf(w, "%d hosts: %d PASS, %d FAIL", len(jobs), len(jobs)-len(failed), len(failed))
+	if len(failed) > 0 {
+		fmt.Fprintf(w, " (%s)", strings.Join(failed, ", "))
+	}
+	fmt.Fprintln(w)
+	return len(failed)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExpectations(t *testing.T) {
+	match, err := compileExpressions([]string{`active \(running\)`, `^Loaded`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notMatch, err := compileExpressions([]string{"ERROR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &expectations{match: match, notMatch: notMatch}
+	running := []string{"Loaded: loaded", "Active: active (running)"}
+
+	for _, tc := range []struct {
+		lines    []string
+		err      error
+		exits    map[int]bool
+		expected string
+	}{
+		{lines: running},
+		{lines: []string{"Loaded: loaded", "Active: inactive (dead)"}, expected: `the output does not match "active \\(running\\)"`},
+		{lines: []string{" Loaded: loaded", "Active: active (running)"}, expected: `the output does not match "^Loaded"`},
+		{lines: append(running, "ERROR disk full"), expected: `the output matches "ERROR"`},
+		{lines: running, err: errors.New("connection lost"), exits: map[int]bool{0: true}, expected: "connection lost"},
+		{lines: running, exits: map[int]bool{3: true}, expected: "unexpected exit status 0"},
+	} {
+		e.exits = tc.exits
+		err := e.check(tc.lines, tc.err)
+		if tc.expected == "" && err != nil {
+			t.Errorf("expected %v to pass, got %v", tc.lines, err)
+		}
+		if tc.expected != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.expected)) {
+			t.Errorf("expected %v to fail with %s, got %v", tc.lines, tc.expected, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// forward is a port forward over the connection to a host.
+type forward struct {
+	// kind is L for a local, R for a remote and D for a dynamic forward
+	kind string
+	// listen is the address listened on, on the host for remote forwards
+	// and locally otherwise. Its port is 0 when it's allocated automatically.
+	listen string
+	// target is the address connections are forwarded to, it's empty
+	// for dynamic forwards
+	target string
+}
+
+func (f forward) String() string {
+	listen := f.listen
+	if strings.HasSuffix(listen, ":0") {
+		listen = strings.TrimSuffix(listen, "0") + "auto"
+	}
+	if f.target == "" {
+		return fmt.Sprintf("%s %s", f.kind, listen)
+	}
+	return fmt.Sprintf("%s %s -> %s", f.kind, listen, f.target)
+}
+
+// parseForward parses a forward specified like the -L, -R and -D flags of ssh:
+// [bind_address:]port:host:hostport for local and remote forwards and
+// [bind_address:]port for dynamic forwards. The port can be auto to allocate
+// a free port for each host and the host defaults to localhost, i.e. auto:9100.
+// The space separated form of the ssh config is accepted as well.
+func parseForward(kind, spec string) (forward, error) {
+	fields := splitForward(strings.Join(strings.Fields(spec), ":"))
+	f := forward{kind: kind}
+
+	var bind, port string
+	switch {
+	case kind == "D" && len(fields) == 1:
+		port = fields[0]
+	case kind == "D" && len(fields) == 2:
+		bind, port = fields[0], fields[1]
+	case kind != "D" && len(fields) == 2:
+		port, f.target = fields[0], net.JoinHostPort("localhost", fields[1])
+	case kind != "D" && len(fields) == 3:
+		port, f.target = fields[0], net.JoinHostPort(fields[1], fields[2])
+	case kind != "D" && len(fields) == 4:
+		bind, port, f.target = fields[0], fields[1], net.JoinHostPort(fields[2], fields[3])
+	default:
+		return f, fmt.Errorf("invalid forward -%s %s", kind, spec)
+	}
+
+	if port == "auto" {
+		port = "0"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return f, fmt.Errorf("invalid port %s in forward -%s %s", port, kind, spec)
+	}
+	if f.target != "" {
+		if _, p, _ := net.SplitHostPort(f.target); p == "" {
+			return f, fmt.Errorf("invalid target in forward -%s %s", kind, spec)
+		}
+	}
+	switch bind {
+	case "", "localhost":
+		bind = "127.0.0.1"
+	case "*":
+		// all interfaces
+		bind = ""
+	}
+	f.listen = net.JoinHostPort(bind, port)
+	return f, nil
+}
+
+// splitForward splits the forward on colons outside of brackets, the
+// brackets around IPv6 addresses are removed.
+func splitForward(spec string) []string {
+	var (
+		fields []string
+		field  strings.Builder
+		quoted bool
+	)
+	for _, r := range spec {
+		switch {
+		case r == '[':
+			quoted = true
+		case r == ']':
+			quoted = false
+		case r == ':' && !quoted:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// parseForwardOptions parses the LocalForward, RemoteForward and DynamicForward
+// options, each holding forwards separated by new lines.
+func parseForwardOptions(options sshconfig.ClientOptions) ([]forward, error) {
+	var forwards []forward
+	for _, o := range []struct{ kind, value string }{
+		{"L", options.LocalForward},
+		{"R", options.RemoteForward},
+		{"D", options.DynamicForward},
+	} {
+		for _, spec := range strings.Split(o.value, "\n") {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			f, err := parseForward(o.kind, spec)
+			if err != nil {
+				return nil, err
+			}
+			forwards = append(forwards, f)
+		}
+	}
+	return forwards, nil
+}
+
+// forwardsFor returns the forwards of the ssh config of a host followed by the
+// forwards of the command line. Like ssh, the forwards of the ssh config are
+// only started with the tunnel command or along with forwards of the command line.
+func (m *multiplexer) forwardsFor(options sshconfig.ClientOptions) ([]forward, error) {
+	if !m.forwardConfig {
+		return m.forwards, nil
+	}
+	forwards, err := parseForwardOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return append(forwards, m.forwards...), nil
+}
+
+// forwarding holds the listeners of the forwards active on a connection.
+type forwarding struct {
+	listeners []net.Listener
+	// active are the forwards with the addresses actually listened on
+	active []forward
+}
+
+// startForwards listens for all the forwards and forwards their
+// connections over the connection to the host until closed. A forward
+// that can't listen is skipped with a warning unless exitOnFailure is true.
+func startForwards(conn *ssh.Client, forwards []forward, exitOnFailure bool) (*forwarding, error) {
+	f := &forwarding{}
+	for _, fwd := range forwards {
+		var (
+			l    net.Listener
+			err  error
+			dial func(addr string) (net.Conn, error)
+		)
+		switch fwd.kind {
+		case "R":
+			l, err = conn.Listen("tcp", fwd.listen)
+			dial = func(addr string) (net.Conn, error) {
+				return net.Dial("tcp", addr)
+			}
+		default:
+			l, err = net.Listen("tcp", fwd.listen)
+			dial = func(addr string) (net.Conn, error) {
+				return conn.Dial("tcp", addr)
+			}
+		}
+		if err != nil {
+			if !exitOnFailure {
+				log.Warnf("forward %s failed - %v", fwd, err)
+				continue
+			}
+			f.Close()
+			return nil, fmt.Errorf("forward %s: %v", fwd, err)
+		}
+		f.listeners = append(f.listeners, l)
+
+		active := fwd
+		active.listen = l.Addr().String()
+		f.active = append(f.active, active)
+		log.Debugf("forwarding %s", active)
+		go serveForward(l, active, dial)
+	}
+	return f, nil
+}
+
+// Close stops listening, connections already forwarded are left open.
+func (f *forwarding) Close() {
+	for _, l := range f.listeners {
+		l.Close()
+	}
+}
+
+func serveForward(l net.Listener, fwd forward, dial func(addr string) (net.Conn, error)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			var (
+				target = fwd.target
+				err    error
+			)
+			if fwd.kind == "D" {
+				if target, err = socksHandshake(c); err != nil {
+					log.Debugf("socks handshake on %s failed - %v", fwd.listen, err)
+					c.Close()
+					return
+				}
+			}
+			remote, err := dial(target)
+			if fwd.kind == "D" {
+				socksReply(c, err)
+			}
+			if err != nil {
+				log.Debugf("forward %s: connecting to %s failed - %v", fwd, target, err)
+				c.Close()
+				return
+			}
+			pipe(c, remote)
+		}()
+	}
+}
+
+// pipe copies between the connections in both directions until both are done.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
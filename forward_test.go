@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	for _, tc := range []struct {
+		kind, spec string
+		expected   forward
+	}{
+		{"L", "auto:9100", forward{"L", "127.0.0.1:0", "localhost:9100"}},
+		{"L", "8080:db:5432", forward{"L", "127.0.0.1:8080", "db:5432"}},
+		{"L", "0.0.0.0:8080:db:5432", forward{"L", "0.0.0.0:8080", "db:5432"}},
+		{"L", "8080 db:5432", forward{"L", "127.0.0.1:8080", "db:5432"}},
+		{"R", "[::1]:9000:[fe80::1]:80", forward{"R", "[::1]:9000", "[fe80::1]:80"}},
+		{"D", "1080", forward{"D", "127.0.0.1:1080", ""}},
+		{"D", "*:auto", forward{"D", ":0", ""}},
+	} {
+		f, err := parseForward(tc.kind, tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		if f != tc.expected {
+			t.Errorf("%s: expected %+v but received %+v", tc.spec, tc.expected, f)
+		}
+	}
+
+	for _, tc := range []struct{ kind, spec string }{
+		{"L", "8080"},
+		{"L", "port:db:5432"},
+		{"D", "a:b:c"},
+		{"R", "70000:db:80"},
+	} {
+		if _, err := parseForward(tc.kind, tc.spec); err == nil {
+			t.Errorf("expected an error for -%s %s", tc.kind, tc.spec)
+		}
+	}
+}
+
+func TestStartForwardsFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	forwards := []forward{
+		{kind: "L", listen: l.Addr().String(), target: "localhost:80"},
+		{kind: "L", listen: "127.0.0.1:0", target: "localhost:80"},
+	}
+
+	// the forward of a port in use is skipped as by ssh
+	f, err := startForwards(nil, forwards, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if len(f.active) != 1 || f.active[0].listen == l.Addr().String() {
+		t.Errorf("expected only the second forward to be active, got %v", f.active)
+	}
+
+	if _, err := startForwards(nil, forwards, true); err == nil {
+		t.Error("expected the forwards to fail with ExitOnForwardFailure")
+	}
+}
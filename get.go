@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	gocontext "context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	units "github.com/docker/go-units"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const defaultNameTemplate = "{{.Host}}/{{.Path}}"
+
+var getCommand = cli.Command{
+	Name:      "get",
+	Usage:     "download a file, glob or directory from all hosts",
+	ArgsUsage: "REMOTE LOCALDIR",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "name-template",
+			Usage: "template of the local path of each file relative to LOCALDIR, with .Host, .Addr, .Port, .Path, .Dir and .Base",
+			Value: defaultNameTemplate,
+		},
+		cli.BoolFlag{
+			Name:  "gzip,z",
+			Usage: "compress the downloaded files with gzip",
+		},
+		cli.StringFlag{
+			Name:  "max-size",
+			Usage: "maximum size downloaded from each host, i.e. 100M",
+		},
+	},
+	Action: getAction,
+}
+
+// getAction downloads the remote path from all hosts into the local directory.
+func getAction(context *cli.Context) error {
+	if context.NArg() != 2 {
+		return fmt.Errorf("REMOTE path and LOCALDIR must be specified")
+	}
+	g := &getter{
+		remote: context.Args().Get(0),
+		local:  context.Args().Get(1),
+		gzip:   context.Bool("gzip"),
+	}
+
+	tmpl, err := template.New("name").Parse(context.String("name-template"))
+	if err != nil {
+		return err
+	}
+	g.name = tmpl
+	if size := context.String("max-size"); size != "" {
+		if g.maxSize, err = units.RAMInBytes(size); err != nil {
+			return err
+		}
+	}
+
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if _, err := m.run(func(_ gocontext.Context, j *job, session *runner.Session) error {
+		client, err := sftp.NewClient(session.Client)
+		if err != nil {
+			return fmt.Errorf("sftp is not available: %v", err)
+		}
+		defer client.Close()
+		return g.get(j, client)
+	}); err != nil {
+		return err
+	}
+
+	log.Debugf("finished downloading %s from all hosts", g.remote)
+	return nil
+}
+
+// getter downloads a remote path to a local directory.
+type getter struct {
+	remote  string
+	local   string
+	name    *template.Template
+	gzip    bool
+	maxSize int64
+}
+
+// nameData is passed to the name template to render the local path of a file.
+type nameData struct {
+	// Host is the host as it was specified by the user
+	Host string
+	// Addr is the host address that was connected to
+	Addr string
+	Port string
+	// Path is the remote path relative to the parent of the matched path
+	Path string
+	Dir  string
+	Base string
+}
+
+func (g *getter) get(j *job, client *sftp.Client) error {
+	matches, err := client.Glob(g.remote)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("%s: %v", g.remote, os.ErrNotExist)
+	}
+
+	var total int64
+	for _, match := range matches {
+		parent := path.Dir(match)
+		walker := client.Walk(match)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return err
+			}
+			info := walker.Stat()
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if g.maxSize > 0 && total+info.Size() > g.maxSize {
+				return g.errMaxSize()
+			}
+
+			rel := strings.TrimPrefix(walker.Path(), parent)
+			local, err := g.localPath(j, strings.TrimPrefix(rel, "/"))
+			if err != nil {
+				return err
+			}
+			n, err := g.getFile(j, client, walker.Path(), info, local, g.maxSize-total)
+			if err != nil {
+				return err
+			}
+			total += n
+		}
+	}
+	return nil
+}
+
+// localPath renders the name template for the remote path of the job's host.
+func (g *getter) localPath(j *job, rel string) (string, error) {
+	host, port, err := net.SplitHostPort(j.host)
+	if err != nil {
+		return "", err
+	}
+	data := nameData{
+		Host: j.name,
+		Addr: host,
+		Port: port,
+		Path: rel,
+		Dir:  path.Dir(rel),
+		Base: path.Base(rel),
+	}
+
+	var buf bytes.Buffer
+	if err := g.name.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	name := filepath.Clean(filepath.FromSlash(buf.String()))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", name, g.local)
+	}
+	if g.gzip {
+		name += ".gz"
+	}
+	return filepath.Join(g.local, name), nil
+}
+
+// errMaxSize is returned once the files downloaded from a host exceed --max-size.
+func (g *getter) errMaxSize() error {
+	return fmt.Errorf("size limit of %s exceeded", units.BytesSize(float64(g.maxSize)))
+}
+
+// getFile downloads the remote file to a temporary file that is renamed to the
+// local path once complete and returns its size. With --max-size, the download
+// fails once it exceeds remaining bytes as the file may grow after its stat.
+func (g *getter) getFile(j *job, client *sftp.Client, remote string, info os.FileInfo, local string, remaining int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return 0, err
+	}
+	rf, err := client.Open(remote)
+	if err != nil {
+		return 0, err
+	}
+	defer rf.Close()
+
+	var r io.Reader = newProgressReader(rf, j, path.Base(remote), info.Size())
+	if g.maxSize > 0 {
+		r = io.LimitReader(r, remaining+1)
+	}
+	tmp := tempName(local)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := g.copy(f, r)
+	if err == nil && g.maxSize > 0 && n > remaining {
+		err = g.errMaxSize()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, os.Rename(tmp, local)
+}
+
+// copy copies r to w, compressed with --gzip, and returns the number of bytes read.
+func (g *getter) copy(w io.Writer, r io.Reader) (int64, error) {
+	if !g.gzip {
+		return io.Copy(w, r)
+	}
+	gz := gzip.NewWriter(w)
+	n, err := io.Copy(gz, r)
+	if err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestGetFileMaxSize(t *testing.T) {
+	c := newSFTPClient(t)
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "growing.log")
+	if err := ioutil.WriteFile(remote, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.Stat(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &getter{
+		local:   dir,
+		name:    template.Must(template.New("name").Parse(defaultNameTemplate)),
+		maxSize: 8,
+	}
+	j := &job{name: "web1", host: "127.0.0.1:22", signal: make(chan struct{})}
+	go func() {
+		for range j.signal {
+		}
+	}()
+	defer close(j.signal)
+	// the remaining budget is smaller than the file, as if it grew after its stat
+	local := filepath.Join(dir, "local.log")
+	if _, err := g.getFile(j, c, remote, info, local, 4); err == nil || err.Error() != g.errMaxSize().Error() {
+		t.Errorf("expected the size limit error, got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*local.log*")); len(files) != 0 {
+		t.Errorf("expected no local file, got %v", files)
+	}
+
+	n, err := g.getFile(j, c, remote, info, local, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 || mustRead(t, local) != "0123456789" {
+		t.Errorf("expected the whole file within the budget, got %d bytes", n)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var keyscanCommand = cli.Command{
+	Name:  "keyscan",
+	Usage: "add the host keys of all hosts to known_hosts",
+	Description: `Each host is connected to like a run would, through the same ProxyCommand, proxy
+   and jump hosts, once for each host key type. The keys that are not known yet are
+   appended to known_hosts. A key that differs from the known key of the same type is
+   reported and left for you to check, the exit status is 1 when a key changed or a
+   host could not be scanned.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "known-hosts",
+			Usage: "known_hosts file the host keys are added to, ~/.ssh/known_hosts by default",
+		},
+		cli.BoolFlag{
+			Name:  "hash",
+			Usage: "hash the host names like HashKnownHosts",
+		},
+		cli.StringSliceFlag{
+			Name:  "type,t",
+			Usage: fmt.Sprintf("host key type to scan, all of %s by default", strings.Join(runner.HostKeyTypes, ", ")),
+		},
+	},
+	Action: keyscanAction,
+}
+
+// scannedKey is a host key offered by a host and its status in known_hosts.
+type scannedKey struct {
+	key    ssh.PublicKey
+	status string
+}
+
+// scannedHost is the outcome of scanning the host keys of a host.
+type scannedHost struct {
+	addr string
+	keys []scannedKey
+	err  error
+}
+
+func keyscanAction(context *cli.Context) error {
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	known, err := loadKnownHosts(context.String("known-hosts"))
+	if err != nil {
+		return err
+	}
+	types := context.StringSlice("type")
+	if len(types) == 0 {
+		types = runner.HostKeyTypes
+	}
+
+	scanned := make([]*scannedHost, len(m.hosts))
+	errs := m.runner.ForEach(gocontext.Background(), m.hosts, func(ctx gocontext.Context, h *runner.Host) error {
+		s := &scannedHost{addr: h.Addr}
+		keys, err := m.runner.HostKeys(ctx, h, types)
+		for _, key := range keys {
+			s.keys = append(s.keys, scannedKey{key: key, status: known.checkType(h.Addr, key)})
+		}
+		s.err = err
+		scanned[h.Index] = s
+		return err
+	}, nil)
+	for i, err := range errs {
+		if scanned[i] == nil {
+			// the host could not be resolved
+			scanned[i] = &scannedHost{addr: m.hosts[i], err: err}
+		}
+	}
+
+	var (
+		lines []string
+		added = make(map[string]bool)
+	)
+	for _, s := range scanned {
+		for i, k := range s.keys {
+			if k.status != hostKeyUnknown {
+				continue
+			}
+			// the same host can be selected more than once
+			id := s.addr + " " + string(k.key.Marshal())
+			if added[id] {
+				s.keys[i].status = hostKeyKnown
+				continue
+			}
+			added[id] = true
+			host := knownhosts.Normalize(s.addr)
+			if context.Bool("hash") {
+				host = knownhosts.HashHostname(host)
+			}
+			lines = append(lines, knownhosts.Line([]string{host}, k.key))
+		}
+	}
+	if err := known.add(lines); err != nil {
+		return fmt.Errorf("adding the host keys to %s failed - %v", known.path, err)
+	}
+
+	if changed, failed := printScanned(os.Stdout, scanned, known.path); changed > 0 || failed > 0 {
+		return fmt.Errorf("%d hosts with changed keys, %d hosts failed", changed, failed)
+	}
+	return nil
+}
+
+// printScanned prints a table of the host keys of each host and returns the
+// number of hosts with changed keys and of hosts that failed.
+func printScanned(w io.Writer, scanned []*scannedHost, path string) (changed, failed int) {
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tTYPE\tFINGERPRINT\tSTATUS")
+
+	var added, known int
+	for _, s := range scanned {
+		var hostChanged bool
+		for _, k := range s.keys {
+			status := k.status
+			switch status {
+			case hostKeyUnknown:
+				added++
+				status = "added"
+			case hostKeyKnown:
+				known++
+			case hostKeyChanged:
+				hostChanged = true
+				status = "CHANGED, not added"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.addr, k.key.Type(), ssh.FingerprintSHA256(k.key), status)
+		}
+		if hostChanged {
+			changed++
+		}
+		if s.err != nil {
+			failed++
+			fmt.Fprintf(tw, "%s\t-\t-\tfailed: %v\n", s.addr, s.err)
+		}
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d hosts: %d keys added to %s, %d known, %d hosts changed, %d failed\n",
+		len(scanned), added, path, known, changed, failed)
+	return changed, failed
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The status of a host key in known_hosts.
+const (
+	hostKeyKnown   = "known"
+	hostKeyUnknown = "unknown"
+	hostKeyChanged = "CHANGED"
+)
+
+// knownHosts checks host keys against a known_hosts file.
+type knownHosts struct {
+	path string
+	// callback is nil when the file does not exist
+	callback ssh.HostKeyCallback
+}
+
+// loadKnownHosts reads the known_hosts file, ~/.ssh/known_hosts when path is empty.
+// A file that does not exist has no known hosts.
+func loadKnownHosts(path string) (*knownHosts, error) {
+	if path == "" {
+		home, err := homeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	k := &knownHosts{path: path}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, err
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+	k.callback = callback
+	return k, nil
+}
+
+// check returns whether the key of the host at addr, host:port, is known,
+// unknown or changed. Like ssh, a key of another type than the known keys of
+// the host is changed. remote is the address the key was presented on.
+func (k *knownHosts) check(addr string, remote net.Addr, key ssh.PublicKey) string {
+	status, _ := k.lookup(addr, remote, key)
+	return status
+}
+
+// checkType returns whether the key of the host at addr is known, unknown or
+// changed compared with the known keys of the host of the same type only.
+func (k *knownHosts) checkType(addr string, key ssh.PublicKey) string {
+	status, want := k.lookup(addr, nil, key)
+	if status != hostKeyChanged {
+		return status
+	}
+	for _, w := range want {
+		if w.Key.Type() == key.Type() {
+			return hostKeyChanged
+		}
+	}
+	return hostKeyUnknown
+}
+
+// lookup returns the status of the key of the host and the known keys of the
+// host when it changed.
+func (k *knownHosts) lookup(addr string, remote net.Addr, key ssh.PublicKey) (string, []knownhosts.KnownKey) {
+	if k.callback == nil {
+		return hostKeyUnknown, nil
+	}
+	if _, ok := remote.(*net.TCPAddr); !ok {
+		// connected through a ProxyCommand, the host is only checked by name
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		remote = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+	}
+	err := k.callback(addr, remote, key)
+	if err == nil {
+		return hostKeyKnown, nil
+	}
+	if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) > 0 {
+		return hostKeyChanged, keyErr.Want
+	}
+	return hostKeyUnknown, nil
+}
+
+// add appends the lines to the known_hosts file, creating it when it does not exist.
+func (k *knownHosts) add(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data := strings.Join(lines, "\n") + "\n"
+	// the last line of the file can be missing its newline
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if size := info.Size(); size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, size-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			data = "\n" + data
+		}
+	}
+	if _, err := f.WriteString(data); err != nil {
+		return err
+	}
+	return f.Close()
+}
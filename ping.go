@@ -0,0 +1,118 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+var pingCommand = cli.Command{
+	Name:  "ping",
+	Usage: "check that all hosts can be connected and authenticated to without running a command",
+	Description: `Each host is connected to like a run would, through the same ProxyCommand, proxy
+   and jump hosts and with the same identities. The time of the TCP connection, the
+   SSH banner, the key exchange and the authentication is reported for each host with
+   its host key checked against known_hosts. The exit status is 1 when a host fails.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "known-hosts",
+			Usage: "known_hosts file the host keys are checked against, ~/.ssh/known_hosts by default",
+		},
+	},
+	Action: pingAction,
+}
+
+func pingAction(context *cli.Context) error {
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	known, err := loadKnownHosts(context.String("known-hosts"))
+	if err != nil {
+		return err
+	}
+
+	probes := make([]*runner.Probe, len(m.hosts))
+	errs := m.runner.ForEach(gocontext.Background(), m.hosts, func(ctx gocontext.Context, h *runner.Host) error {
+		probes[h.Index] = m.runner.Probe(ctx, h)
+		return probes[h.Index].Err
+	}, nil)
+	for i, err := range errs {
+		if probes[i] == nil {
+			// the host could not be resolved
+			probes[i] = &runner.Probe{
+				Host:  &runner.Host{Name: m.hosts[i], Index: i},
+				Stage: runner.StageConnect,
+				Err:   err,
+			}
+		}
+	}
+
+	if failed := printProbes(os.Stdout, probes, known); failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(probes))
+	}
+	return nil
+}
+
+// printProbes prints a table of the stages of connecting to each host and
+// returns the number of hosts that failed.
+func printProbes(w io.Writer, probes []*runner.Probe, known *knownHosts) int {
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tADDRESS\tCONNECT\tBANNER\tKEX\tHOST KEY\tAUTH\tRESULT")
+
+	var failed, unknown, changed int
+	for _, p := range probes {
+		var (
+			banner, kex, hostKey, auth = "-", "-", "-", "-"
+			result                     = "ok"
+			connect                    = "-"
+			addr                       = p.Host.Addr
+		)
+		if addr == "" {
+			// the host could not be resolved
+			addr = "-"
+		}
+		if p.Stage != runner.StageConnect {
+			connect = formatLatency(p.Connect)
+		}
+		if p.Banner != "" {
+			banner = fmt.Sprintf("%s %s", p.Banner, formatLatency(p.BannerTime))
+		}
+		if p.HostKey != nil {
+			kex = formatLatency(p.KeyExchangeTime)
+			status := known.check(p.Host.Addr, p.Remote, p.HostKey)
+			switch status {
+			case hostKeyUnknown:
+				unknown++
+			case hostKeyChanged:
+				changed++
+			}
+			hostKey = fmt.Sprintf("%s %s %s", p.HostKey.Type(), ssh.FingerprintSHA256(p.HostKey), status)
+		}
+		if p.Err == nil {
+			auth = fmt.Sprintf("%s %s", p.Identity, formatLatency(p.AuthTime))
+		} else {
+			failed++
+			result = fmt.Sprintf("failed at %s: %v", p.Stage, p.Err)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Host.Name, addr, connect, banner, kex, hostKey, auth, result)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d hosts: %d ok, %d failed, %d host keys unknown, %d changed\n",
+		len(probes), len(probes)-failed, failed, unknown, changed)
+	return failed
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+)
+
+func TestPrintProbes(t *testing.T) {
+	probes := []*runner.Probe{
+		{
+			Host:    &runner.Host{Name: "web", Addr: "10.0.0.1:22"},
+			Stage:   runner.StageAuth,
+			Connect: time.Millisecond,
+			Err:     errors.New("permission denied"),
+		},
+		{
+			Host:  &runner.Host{Name: "db", Index: 1},
+			Stage: runner.StageConnect,
+			Err:   errors.New("no such host"),
+		},
+	}
+	var out bytes.Buffer
+	if failed := printProbes(&out, probes, nil); failed != 2 {
+		t.Errorf("expected 2 hosts to fail, got %d", failed)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if fields := strings.Fields(lines[0]); fields[0] != "HOST" || fields[1] != "ADDRESS" {
+		t.Errorf("expected the host and the address columns, got %q", lines[0])
+	}
+	for i, expected := range [][]string{{"web", "10.0.0.1:22"}, {"db", "-"}} {
+		if fields := strings.Fields(lines[i+1]); fields[0] != expected[0] || fields[1] != expected[1] {
+			t.Errorf("expected the host %s at %s, got %q", expected[0], expected[1], lines[i+1])
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package runner
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agents keeps a single connection open to each ssh agent socket used during a run
+// so that hosts sharing an agent do not each dial the socket.
+type agents struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	cache map[string]agent.Agent
+}
+
+func newAgents() *agents {
+	return &agents{
+		conns: make(map[string]net.Conn),
+		cache: make(map[string]agent.Agent),
+	}
+}
+
+// get returns the agent listening on the given socket, connecting to it on first use.
+func (a *agents) get(sock string) (agent.Agent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if agt, ok := a.cache[sock]; ok {
+		return agt, nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	agt := agent.NewClient(conn)
+	a.conns[sock] = conn
+	a.cache[sock] = agt
+	return agt, nil
+}
+
+// Default returns the agent referenced by SSH_AUTH_SOCK.
+func (a *agents) Default() (agent.Agent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("Unable to connect to the ssh agent. Please, check that SSH_AUTH_SOCK is set and the ssh agent is running")
+	}
+	return a.get(sock)
+}
+
+// Forward resolves the value of the ForwardAgent client option to the agent that
+// authentication requests are forwarded to. A nil agent is returned when forwarding
+// is disabled. Besides "yes" and "no", the value may be the path to an agent socket
+// or the name of an environment variable holding one, i.e. "$SSH_AUTH_SOCK".
+func (a *agents) Forward(value string) (agent.Agent, error) {
+	switch strings.ToLower(value) {
+	case "", "no":
+		return nil, nil
+	case "yes":
+		return a.Default()
+	}
+
+	sock := value
+	if strings.HasPrefix(sock, "$") {
+		sock = os.Getenv(sock[1:])
+		if sock == "" {
+			log.Debugf("ForwardAgent %s is not set, agent forwarding disabled", value)
+			return nil, nil
+		}
+	}
+	if strings.HasPrefix(sock, "~/") {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		sock = filepath.Join(u.HomeDir, sock[2:])
+	}
+	return a.get(sock)
+}
+
+// Close closes the connections to all the agents.
+func (a *agents) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for sock, conn := range a.conns {
+		conn.Close()
+		delete(a.conns, sock)
+		delete(a.cache, sock)
+	}
+}
@@ -0,0 +1,72 @@
+package runner
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentsForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		keyring := agent.NewKeyring()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+
+	os.Setenv("TEST_SLEX_AGENT_SOCK", sock)
+	defer os.Unsetenv("TEST_SLEX_AGENT_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", sock)
+
+	a := newAgents()
+	defer a.Close()
+
+	for _, value := range []string{"", "no", "No", "$TEST_SLEX_AGENT_UNSET"} {
+		agt, err := a.Forward(value)
+		if err != nil {
+			t.Errorf("ForwardAgent %q returned error: %v", value, err)
+		}
+		if agt != nil {
+			t.Errorf("ForwardAgent %q should disable forwarding", value)
+		}
+	}
+
+	for _, value := range []string{"yes", sock, "$TEST_SLEX_AGENT_SOCK"} {
+		agt, err := a.Forward(value)
+		if err != nil {
+			t.Errorf("ForwardAgent %q returned error: %v", value, err)
+			continue
+		}
+		if agt == nil {
+			t.Errorf("ForwardAgent %q should enable forwarding", value)
+			continue
+		}
+		if _, err := agt.List(); err != nil {
+			t.Errorf("ForwardAgent %q returned unusable agent: %v", value, err)
+		}
+	}
+	if len(a.conns) != 1 {
+		t.Errorf("expected a single connection to the agent socket, got %d", len(a.conns))
+	}
+}
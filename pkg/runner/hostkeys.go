@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyTypes are the types of host keys collected by HostKeys by default.
+// The RSA keys are scanned with the SHA-2 signature algorithms, see hostKeyAlgorithms.
+var HostKeyTypes = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+// errHostKeyScanned stops the handshake once the host key is received.
+var errHostKeyScanned = errors.New("host key scanned")
+
+// HostKeys connects to the host once for each of the types, through the same
+// ProxyCommand, proxy and jump hosts as Connect, and returns the host keys it
+// offers. The connections are closed before authenticating with the host, the
+// jump hosts are connected to once for all the types.
+func (r *Runner) HostKeys(ctx context.Context, h *Host, types []string) ([]ssh.PublicKey, error) {
+	jumps, err := r.jumpHosts(h.Options)
+	if err != nil {
+		return nil, err
+	}
+	config := newSSHClientConfig(h.User, h.Addr, h.Name, nil, nil)
+	config.Auth = nil
+	config.jumps = jumps
+	keys, reached, err := config.hostKeys(ctx, h.Options, types)
+	if reached && err == nil && len(keys) == 0 {
+		err = fmt.Errorf("the host offered none of the host key types %s", strings.Join(types, ", "))
+	}
+	return keys, err
+}
+
+// hostKeyAlgorithms returns the host key algorithms offered to the host to scan
+// its key of the type. RSA keys are signed with SHA-2 unless the host only
+// supports the legacy ssh-rsa signatures.
+func hostKeyAlgorithms(typ string) []string {
+	if typ == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{typ}
+}
+
+// hostKeys connects to the host once for each of the types and returns the keys it
+// offers. reached is false when the host could not be connected to.
+func (s *sshClientConfig) hostKeys(ctx context.Context, options sshconfig.ClientOptions, types []string) (keys []ssh.PublicKey, reached bool, err error) {
+	timeout, err := connectTimeout(options.ConnectTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+	var dial dialFunc
+	if !IsProxyCommand(options.ProxyCommand) {
+		var closeJumps func()
+		if dial, closeJumps, err = s.dialJumps(ctx, options, timeout); err != nil {
+			return nil, false, err
+		}
+		defer closeJumps()
+	}
+
+	config := s.ClientConfig
+	defer func() {
+		s.ClientConfig = config
+	}()
+	for _, typ := range types {
+		var key ssh.PublicKey
+		target := *config
+		target.HostKeyAlgorithms = hostKeyAlgorithms(typ)
+		target.HostKeyCallback = func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errHostKeyScanned
+		}
+		s.ClientConfig = &target
+		s.trace = &trace{start: time.Now()}
+
+		var conn *ssh.Client
+		if dial != nil {
+			conn, err = newClient(ctx, dial, s.host, s.ClientConfig, timeout, s.trace)
+		} else {
+			conn, _, err = s.connect(ctx, options)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		switch {
+		case key != nil:
+			keys = append(keys, key)
+		case s.trace.reached():
+			// the key exchange fails when the host has no key of the type
+			log.Debugf("%s offered no %s host key - %v", s.host, typ, err)
+		default:
+			return keys, reached, err
+		}
+		reached = true
+	}
+	return keys, reached, nil
+}
+
+// reached returns whether the SSH version of the host was received.
+func (t *trace) reached() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.banner.IsZero()
+}
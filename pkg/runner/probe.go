@@ -0,0 +1,193 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Stage is a stage of connecting to a host.
+type Stage string
+
+const (
+	// StageConnect establishes the TCP connection, through the proxy and jump hosts
+	StageConnect Stage = "connect"
+	// StageBanner waits for the SSH version of the host
+	StageBanner Stage = "banner"
+	// StageKeyExchange negotiates the keys and receives the host key
+	StageKeyExchange Stage = "key exchange"
+	// StageAuth authenticates with the identities
+	StageAuth Stage = "auth"
+)
+
+// Probe is the outcome of connecting and authenticating to a host without
+// opening a session, with the time each stage took.
+type Probe struct {
+	Host *Host
+	// Connect is the time to establish the TCP connection
+	Connect time.Duration
+	// Banner is the SSH version the host identified with
+	Banner     string
+	BannerTime time.Duration
+	// HostKey is the key presented by the host and Remote the address it was presented on
+	HostKey         ssh.PublicKey
+	Remote          net.Addr
+	KeyExchangeTime time.Duration
+	// Identity is the authentication method that was accepted
+	Identity string
+	AuthTime time.Duration
+	// Stage is the stage that failed with Err
+	Stage Stage
+	Err   error
+}
+
+// Probe connects and authenticates to the host like Connect, through the same
+// ProxyCommand, proxy and jump hosts and with the same identities, without
+// opening a session.
+func (r *Runner) Probe(ctx context.Context, h *Host) *Probe {
+	p := &Probe{Host: h}
+	options := h.Options
+	jumps, err := r.jumpHosts(options)
+	if err != nil {
+		p.Err = err
+		return p
+	}
+
+	var lastErr error
+	for k, method := range r.authMethods(options) {
+		if err := ctx.Err(); err != nil {
+			p.Err = err
+			return p
+		}
+		t := &trace{start: time.Now()}
+		config := newSSHClientConfig(h.User, h.Addr, h.Name, nil, method)
+		config.trace = t
+		config.jumps = jumps
+		conn, _, err := config.connect(ctx, options)
+		t.record(p)
+		if err == nil {
+			conn.Close()
+			p.Identity, p.Stage = k, ""
+			return p
+		}
+		log.Debugf("Probing %s using identity file %s failed - %v", h.Addr, k, err)
+		lastErr = err
+		if p.Stage != StageAuth {
+			// the host can't be reached with any identity
+			p.Err = err
+			return p
+		}
+	}
+
+	p.Stage = StageAuth
+	if lastErr != nil {
+		p.Err = fmt.Errorf("none of the provided authentication methods can establish SSH session successfully - %v", lastErr)
+	} else {
+		p.Err = fmt.Errorf("none of the provided authentication methods can establish SSH session successfully")
+	}
+	return p
+}
+
+// trace records the time of the stages of connecting to a host.
+type trace struct {
+	start time.Time
+
+	mu      sync.Mutex
+	connect time.Time
+	banner  time.Time
+	keys    time.Time
+	version string
+	hostKey ssh.PublicKey
+	remote  net.Addr
+}
+
+// connected records that the connection is established and returns the connection
+// and config to use for the handshake to record its stages.
+func (t *trace) connected(c net.Conn, config *ssh.ClientConfig) (net.Conn, *ssh.ClientConfig) {
+	t.mu.Lock()
+	t.connect = time.Now()
+	t.mu.Unlock()
+
+	traced := *config
+	callback := config.HostKeyCallback
+	traced.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		t.mu.Lock()
+		t.keys = time.Now()
+		t.hostKey, t.remote = key, remote
+		t.mu.Unlock()
+		return callback(hostname, remote, key)
+	}
+	return &bannerConn{Conn: c, t: t}, &traced
+}
+
+// record sets the time each stage took and the stage that was not completed.
+func (t *trace) record(p *Probe) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	end := time.Now()
+	p.Stage = ""
+	p.Connect, p.BannerTime, p.KeyExchangeTime, p.AuthTime = 0, 0, 0, 0
+	switch {
+	case t.connect.IsZero():
+		p.Stage = StageConnect
+		return
+	case t.banner.IsZero():
+		p.Stage = StageBanner
+	case t.keys.IsZero():
+		p.Stage = StageKeyExchange
+	default:
+		p.Stage = StageAuth
+	}
+	p.Connect = t.connect.Sub(t.start)
+	if !t.banner.IsZero() {
+		p.Banner = t.version
+		p.BannerTime = t.banner.Sub(t.connect)
+	}
+	if !t.keys.IsZero() {
+		p.HostKey, p.Remote = t.hostKey, t.remote
+		p.KeyExchangeTime = t.keys.Sub(t.banner)
+		p.AuthTime = end.Sub(t.keys)
+	}
+}
+
+// bannerConn records when the SSH version of the host is received.
+type bannerConn struct {
+	net.Conn
+	t    *trace
+	line []byte
+	done bool
+}
+
+func (c *bannerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.done {
+		return n, err
+	}
+	for _, b := range p[:n] {
+		if b != '\n' {
+			if len(c.line) < 256 {
+				c.line = append(c.line, b)
+			}
+			continue
+		}
+		// the host can send other lines before its version
+		line := string(bytes.TrimSuffix(c.line, []byte("\r")))
+		c.line = c.line[:0]
+		if strings.HasPrefix(line, "SSH-") {
+			c.t.mu.Lock()
+			c.t.banner, c.t.version = time.Now(), line
+			c.t.mu.Unlock()
+			c.done = true
+			break
+		}
+	}
+	return n, err
+}
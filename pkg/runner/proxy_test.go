@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshtest"
+)
+
+// newBannerServer starts a server sending a banner to each connection and
+// echoing the lines it receives, like an ssh server sends its version first.
+func newBannerServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "SSH-2.0-test\r\n")
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// expectBanner checks the banner of the server is read first from the connection
+// and that the connection echoes what is written.
+func expectBanner(t *testing.T, c net.Conn) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if banner, err := r.ReadString('\n'); err != nil || banner != "SSH-2.0-test\r\n" {
+		t.Fatalf("expected the banner, got %q - %v", banner, err)
+	}
+	if _, err := io.WriteString(c, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("expected the echo, got %q - %v", line, err)
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	target := newBannerServer(t)
+	_, port, _ := net.SplitHostPort(target)
+	p, err := sshtest.NewSOCKS5Proxy("slex", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, tc := range []struct {
+		url string
+		// sent is the target as it's sent to the proxy
+		sent string
+		err  string
+	}{
+		{url: "socks5://slex:secret@" + p.Addr(), sent: "127.0.0.1:" + port},
+		{url: "socks5h://slex:secret@" + p.Addr(), sent: "localhost:" + port},
+		{url: "socks5h://slex:wrong@" + p.Addr(), err: "socks authentication failed"},
+		{url: "socks5h://" + p.Addr(), err: "socks proxy requires authentication"},
+	} {
+		dial, err := newProxyDialer(context.Background(), tc.url, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets := len(p.Targets())
+		c, err := dial("tcp", "localhost:"+port)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected an error with %q, got %v", RedactURL(tc.url), tc.err, err)
+			}
+			if err == nil {
+				c.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", RedactURL(tc.url), err)
+		}
+		expectBanner(t, c)
+		c.Close()
+		if sent := p.Targets()[targets:]; len(sent) != 1 || sent[0] != tc.sent {
+			t.Errorf("%s: expected %s to be sent to the proxy, got %v", RedactURL(tc.url), tc.sent, sent)
+		}
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	target := newBannerServer(t)
+	p, err := sshtest.NewHTTPProxy("slex", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// the proxy sends the banner of the target with its response
+	dial, err := newProxyDialer(context.Background(), "http://slex:secret@"+p.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*bufferedConn); !ok {
+		t.Errorf("expected the connection to read what was buffered with the response, got %T", c)
+	}
+	expectBanner(t, c)
+
+	dial, err = newProxyDialer(context.Background(), "http://slex:wrong@"+p.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial("tcp", target); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("expected the proxy to require authentication, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	shlex "github.com/flynn/go-shlex"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// proxyStderrLimit is how much of the end of the stderr of the ProxyCommand is kept
+	proxyStderrLimit = 4096
+	// proxyExitTimeout is how long the ProxyCommand has to exit once its stdin
+	// is closed before it's killed
+	proxyExitTimeout = 5 * time.Second
+)
+
+// proxyCmdConn is a Conn for talking to the underlying ProxyCommand.
+type proxyCmdConn struct {
+	cmd *exec.Cmd
+	// stdout is read from and stdin is written to, both are pipes
+	// so that deadlines can be set on them
+	stdout *os.File
+	stdin  *os.File
+	stderr *tailBuffer
+	remote proxyAddr
+
+	mu sync.Mutex
+	// timedOut is true once a read or write reached the deadline
+	timedOut bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newProxyCmdConn creates a new proxyCmdConn
+// and starts the underlying ProxyCommand.
+func newProxyCmdConn(s *sshClientConfig, cmd string) (*proxyCmdConn, error) {
+	host, port, err := net.SplitHostPort(s.host)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := shlex.Split(ExpandProxyCommand(cmd, host, port, s.User, s.name))
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty ProxyCommand")
+	}
+
+	c := exec.Command(args[0], args[1:]...)
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	stderr := &tailBuffer{limit: proxyStderrLimit}
+	c.Stdin, c.Stdout, c.Stderr = stdinR, stdoutW, stderr
+
+	err = c.Start()
+	// the ends of the pipes used by the command are only needed by the child
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+	log.Debugf("ProxyCommand started: '%s %s'.", args[0], strings.Join(args[1:], " "))
+
+	return &proxyCmdConn{
+		cmd:    c,
+		stdout: stdoutR,
+		stdin:  stdinW,
+		stderr: stderr,
+		remote: proxyAddr(s.host),
+	}, nil
+}
+
+// IsProxyCommand returns true when the ProxyCommand option is set to a command.
+func IsProxyCommand(cmd string) bool {
+	return cmd != "" && !strings.EqualFold(cmd, "none")
+}
+
+// ExpandProxyCommand replaces the tokens of the ProxyCommand:
+// %h the host, %p the port, %r the remote user, %n the host as
+// it was specified by the user and %% a literal %.
+func ExpandProxyCommand(cmd, host, port, user, name string) string {
+	var b strings.Builder
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] != '%' || i+1 == len(cmd) {
+			b.WriteByte(cmd[i])
+			continue
+		}
+		i++
+		switch cmd[i] {
+		case 'h':
+			b.WriteString(host)
+		case 'p':
+			b.WriteString(port)
+		case 'r':
+			b.WriteString(user)
+		case 'n':
+			b.WriteString(name)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(cmd[i])
+		}
+	}
+	return b.String()
+}
+
+func (c *proxyCmdConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	c.checkTimeout(err)
+	return n, err
+}
+
+func (c *proxyCmdConn) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	c.checkTimeout(err)
+	return n, err
+}
+
+func (c *proxyCmdConn) checkTimeout(err error) {
+	if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+		c.mu.Lock()
+		c.timedOut = true
+		c.mu.Unlock()
+	}
+}
+
+// Close closes the pipes and waits for the ProxyCommand to exit,
+// killing it when it does not exit on its own or it's stuck.
+func (c *proxyCmdConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.timedOut {
+			c.cmd.Process.Kill()
+		}
+		c.mu.Unlock()
+
+		// Stdin pipe must be closed before stdout pipe
+		// so that the underlying command knows it's time to end.
+		c.closeErr = c.stdin.Close()
+		if err := c.stdout.Close(); err != nil && c.closeErr == nil {
+			c.closeErr = err
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- c.cmd.Wait()
+		}()
+		select {
+		case err := <-done:
+			log.Debugf("ProxyCommand exited - %v", err)
+		case <-time.After(proxyExitTimeout):
+			log.Debugf("ProxyCommand did not exit, killing it")
+			c.cmd.Process.Kill()
+			<-done
+		}
+	})
+	return c.closeErr
+}
+
+// annotate adds the stderr of the ProxyCommand to errors other than the exit
+// status of a command, as they can be caused by the proxy failing.
+func (c *proxyCmdConn) annotate(err error) error {
+	if _, ok := err.(*ssh.ExitError); ok || err == nil {
+		return err
+	}
+	stderr := strings.TrimSpace(c.stderr.String())
+	if stderr == "" {
+		return err
+	}
+	return fmt.Errorf("%v (ProxyCommand: %s)", err, stderr)
+}
+
+func (c *proxyCmdConn) LocalAddr() net.Addr {
+	return proxyAddr("")
+}
+
+func (c *proxyCmdConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyCmdConn) SetDeadline(t time.Time) error {
+	if err := c.stdout.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *proxyCmdConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *proxyCmdConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
+
+// proxyAddr is the address of a connection through a ProxyCommand.
+type proxyAddr string
+
+func (a proxyAddr) Network() string {
+	return "proxy"
+}
+
+func (a proxyAddr) String() string {
+	return string(a)
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	log.Debugf("ProxyCommand stderr: %s", bytes.TrimSpace(p))
+	b.buf = append(b.buf, p...)
+	if n := len(b.buf) - b.limit; n > 0 {
+		b.buf = append(b.buf[:0], b.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
@@ -0,0 +1,19 @@
+package runner
+
+import "testing"
+
+func TestExpandProxyCommand(t *testing.T) {
+	for cmd, expected := range map[string]string{
+		"ssh -W %h:%p %r@jump":  "ssh -W 10.0.0.1:2222 deploy@jump",
+		"connect %n 100%% %x %": "connect web 100% %x %",
+		"nc %h %p":              "nc 10.0.0.1 2222",
+		"plain":                 "plain",
+	} {
+		if out := ExpandProxyCommand(cmd, "10.0.0.1", "2222", "deploy", "web"); out != expected {
+			t.Errorf("expected %q for %q but received %q", expected, cmd, out)
+		}
+	}
+	if IsProxyCommand("none") || IsProxyCommand("") || !IsProxyCommand("nc %h %p") {
+		t.Error("ProxyCommand none is not treated as no proxy")
+	}
+}
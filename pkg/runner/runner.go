@@ -0,0 +1,410 @@
+// Package runner connects to hosts over SSH with the OpenSSH client config and
+// executes commands, or any action using the connection, on many hosts at once.
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Options configure how the runner connects to the hosts.
+type Options struct {
+	// User is the user to connect as unless the ssh config of the host sets one,
+	// root when empty
+	User string
+	// IdentityFiles are the private keys used for authentication,
+	// the default keys in ~/.ssh are used when empty
+	IdentityFiles []string
+	// UseAgent authenticates with the keys of the ssh agent of SSH_AUTH_SOCK
+	UseAgent bool
+	// SSHConfig are the sections of the ssh config by host, see sshconfig.ParseFile
+	SSHConfig map[string]sshconfig.ClientOptions
+	// ClientOptions override the options of the ssh config for every host
+	ClientOptions sshconfig.ClientOptions
+	// Concurrency is how many hosts are handled at once, 10 when zero
+	Concurrency int
+}
+
+// Runner connects to hosts and runs actions on them concurrently.
+type Runner struct {
+	opts    Options
+	agents  *agents
+	methods map[string]ssh.AuthMethod
+
+	mu          sync.Mutex
+	concurrency int
+}
+
+// New returns a runner with the options. The runner must be closed to release
+// the connections to the ssh agents.
+func New(opts Options) (*Runner, error) {
+	if opts.User == "" {
+		opts.User = "root"
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 10
+	}
+
+	// The agent is used for authentication when requested, forwarding
+	// is decided per host by ForwardAgent.
+	agents := newAgents()
+	var agt agent.Agent
+	if opts.UseAgent {
+		var err error
+		if agt, err = agents.Default(); err != nil {
+			agents.Close()
+			return nil, err
+		}
+	}
+	return &Runner{
+		opts:        opts,
+		agents:      agents,
+		methods:     defaultAuthMethods(opts.IdentityFiles, agt),
+		concurrency: opts.Concurrency,
+	}, nil
+}
+
+// Close releases the connections to the ssh agents.
+func (r *Runner) Close() error {
+	r.agents.Close()
+	return nil
+}
+
+// SetConcurrency changes how many hosts are handled at once by the following runs.
+func (r *Runner) SetConcurrency(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.concurrency = n
+}
+
+// Identities returns the names of the authentication methods tried for every
+// host, the identity files and ssh-agent, sorted.
+func (r *Runner) Identities() []string {
+	var names []string
+	for k := range r.methods {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Host is a host the runner connects to.
+type Host struct {
+	// Name is the host as it was specified
+	Name string
+	// Index is the position of the host in the hosts of the run
+	Index int
+	// Addr is the host:port address connected to, resolved from the ssh config
+	Addr string
+	// User is the user connected as
+	User string
+	// Options are the effective client options of the host
+	Options sshconfig.ClientOptions
+}
+
+// Resolve returns the host with the address, user and client options it's connected with.
+func (r *Runner) Resolve(name string, index int) (*Host, error) {
+	addr, err := cleanHost(name)
+	if err != nil {
+		return nil, err
+	}
+	options := sshconfig.Merge(r.opts.SSHConfig[name], r.opts.ClientOptions)
+	h := &Host{
+		Name:    name,
+		Index:   index,
+		Addr:    addr,
+		User:    r.opts.User,
+		Options: options,
+	}
+	if options.User != "" {
+		h.User = options.User
+	}
+	if options.HostName != "" {
+		port := options.Port
+		if port == "" {
+			port = "22"
+		}
+		h.Addr = net.JoinHostPort(options.HostName, port)
+	}
+	return h, nil
+}
+
+// Connect establishes an SSH session with the host.
+// All available SSH authentication methods to the host will be tried.
+func (r *Runner) Connect(ctx context.Context, h *Host) (*Session, error) {
+	options := h.Options
+	log.Debugf("Using SSH client options: %q", options)
+
+	agt, err := r.agents.Forward(options.ForwardAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	jumps, err := r.jumpHosts(options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try using each available AuthMethod to establish SSH session:
+	var lastErr error
+	for k, method := range r.authMethods(options) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		config := newSSHClientConfig(h.User, h.Addr, h.Name, agt, method)
+		config.jumps = jumps
+		session, err := config.NewSession(ctx, options)
+		if err == nil {
+			log.Debugf("Session established using identity file %s", k)
+			return session, nil
+		}
+
+		log.Debugf("Failed to establish session using identity file %s - %v", k, err)
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("none of the provided authentication methods can establish SSH session successfully - %v", lastErr)
+	}
+	return nil, fmt.Errorf("none of the provided authentication methods can establish SSH session successfully")
+}
+
+// ConnectIdentity establishes an SSH session with the host as user, authenticating
+// with the identity file only. The jump hosts are still authenticated with their
+// own identities, it's used to check that an identity can log in.
+func (r *Runner) ConnectIdentity(ctx context.Context, h *Host, user, identityFile string) (*Session, error) {
+	method, err := newSSHPublicKeyAuthMethod(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	jumps, err := r.jumpHosts(h.Options)
+	if err != nil {
+		return nil, err
+	}
+	config := newSSHClientConfig(user, h.Addr, h.Name, nil, method)
+	config.jumps = jumps
+	return config.NewSession(ctx, h.Options)
+}
+
+// authMethods returns the authentication methods of the runner and the
+// identity file of the options.
+func (r *Runner) authMethods(options sshconfig.ClientOptions) map[string]ssh.AuthMethod {
+	if options.IdentityFile == "" {
+		return r.methods
+	}
+	im, err := newSSHPublicKeyAuthMethod(options.IdentityFile)
+	if err != nil {
+		return r.methods
+	}
+	// copy the shared methods as other workers are iterating over them
+	methods := make(map[string]ssh.AuthMethod, len(r.methods)+1)
+	for k, v := range r.methods {
+		methods[k] = v
+	}
+	methods[options.IdentityFile] = im
+	return methods
+}
+
+// EventType is the type of an event of a run.
+type EventType int
+
+const (
+	// HostStarted is sent when a worker starts handling the host, the
+	// host is not resolved when its name is invalid
+	HostStarted EventType = iota + 1
+	// HostConnected is sent once the session with the host is established
+	HostConnected
+	// HostOutput is sent with the output of the command on the host
+	HostOutput
+	// HostFinished is sent once the host is handled with the error of the host
+	HostFinished
+)
+
+// Event reports the progress of a host during a run.
+type Event struct {
+	Type EventType
+	Host *Host
+	// Data is the output of a HostOutput event
+	Data []byte
+	// Stderr is true when the output is from the stderr of the command
+	Stderr bool
+	// Err is the error of the host of a HostFinished event
+	Err error
+}
+
+// Handler receives the events of a run, it's called by the workers concurrently.
+type Handler func(Event)
+
+// ForEach calls fn for each host using the configured concurrency and returns the
+// errors of the hosts in the order of the hosts. Hosts are not started once the
+// context is done. The handler, when not nil, receives the HostStarted and
+// HostFinished events.
+func (r *Runner) ForEach(ctx context.Context, names []string, fn func(ctx context.Context, h *Host) error, handler Handler) []error {
+	if handler == nil {
+		handler = func(Event) {}
+	}
+	r.mu.Lock()
+	concurrency := r.concurrency
+	r.mu.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		work = make(chan int)
+		errs = make([]error, len(names))
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				h, err := r.Resolve(names[i], i)
+				if err != nil {
+					h = &Host{Name: names[i], Index: i, Addr: names[i]}
+				}
+				handler(Event{Type: HostStarted, Host: h})
+				if err == nil {
+					if err = ctx.Err(); err == nil {
+						err = fn(ctx, h)
+					}
+				}
+				errs[i] = err
+				handler(Event{Type: HostFinished, Host: h, Err: err})
+			}
+		}()
+	}
+	for i := range names {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
+
+// Each connects to each host and calls fn with the session, see ForEach.
+// The handler also receives the HostConnected events.
+func (r *Runner) Each(ctx context.Context, names []string, fn func(ctx context.Context, h *Host, s *Session) error, handler Handler) []error {
+	return r.ForEach(ctx, names, func(ctx context.Context, h *Host) error {
+		s, err := r.Connect(ctx, h)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if handler != nil {
+			handler(Event{Type: HostConnected, Host: h})
+		}
+		return s.Annotate(fn(ctx, h, s))
+	}, handler)
+}
+
+// Command is executed on every host by Run.
+type Command struct {
+	Cmd string
+	// Env are environment variables to pass to the command
+	Env map[string]string
+}
+
+// Result is the outcome of a command on a host.
+type Result struct {
+	Host *Host
+	// ExitCode is the exit status of the command, -1 when it did not exit
+	ExitCode int
+	Err      error
+}
+
+// Run executes the command on every host and returns the result of each host in
+// the order of the hosts. The output of the command is delivered to the handler
+// as HostOutput events. The command is interrupted when the context is done.
+func (r *Runner) Run(ctx context.Context, names []string, c Command, handler Handler) []Result {
+	results := make([]Result, len(names))
+	record := func(e Event) {
+		if e.Type == HostStarted {
+			results[e.Host.Index].Host = e.Host
+		}
+		if handler != nil {
+			handler(e)
+		}
+	}
+	errs := r.Each(ctx, names, func(ctx context.Context, h *Host, s *Session) error {
+		if handler != nil {
+			s.Stdout = &eventWriter{host: h, handler: handler}
+			s.Stderr = &eventWriter{host: h, handler: handler, stderr: true}
+		}
+		for key, value := range c.Env {
+			if err := s.Setenv(key, value); err != nil {
+				return err
+			}
+		}
+		if err := s.Start(c.Cmd); err != nil {
+			return err
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Wait()
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			s.Signal(ssh.SIGTERM)
+			s.Session.Close()
+			<-done
+			return ctx.Err()
+		}
+	}, record)
+
+	for i, err := range errs {
+		res := &results[i]
+		res.Err = err
+		switch e := err.(type) {
+		case nil:
+		case *ssh.ExitError:
+			res.ExitCode = e.ExitStatus()
+		default:
+			res.ExitCode = -1
+		}
+	}
+	return results
+}
+
+// eventWriter sends the output written to it as HostOutput events.
+type eventWriter struct {
+	host    *Host
+	handler Handler
+	stderr  bool
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.handler(Event{
+		Type:   HostOutput,
+		Host:   w.host,
+		Data:   append([]byte(nil), p...),
+		Stderr: w.stderr,
+	})
+	return len(p), nil
+}
+
+// cleanHost parses out the hostname/ip and port.  If no port is
+// specified then port 22 is appended to the hostname/ip
+func cleanHost(host string) (string, error) {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		if !strings.Contains(err.Error(), "missing port in address") {
+			return "", err
+		}
+		port = "22"
+		h = host
+	}
+	if port == "" {
+		port = "22"
+	}
+	return net.JoinHostPort(h, port), nil
+}
@@ -0,0 +1,290 @@
+package runner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	"github.com/crosbymichael/slex/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestResolve(t *testing.T) {
+	r := &Runner{opts: Options{
+		User: "root",
+		SSHConfig: map[string]sshconfig.ClientOptions{
+			"web": {HostName: "10.0.0.1", Port: "2222", User: "deploy"},
+			"db":  {User: "postgres"},
+		},
+		ClientOptions: sshconfig.ClientOptions{Port: "2200"},
+	}}
+
+	for _, tc := range []struct {
+		name, addr, user string
+	}{
+		{"web", "10.0.0.1:2200", "deploy"},
+		{"db", "db:22", "postgres"},
+		{"10.0.0.2:2201", "10.0.0.2:2201", "root"},
+	} {
+		h, err := r.Resolve(tc.name, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if h.Addr != tc.addr || h.User != tc.user || h.Index != 1 {
+			t.Errorf("%s: expected %s@%s, got %s@%s", tc.name, tc.user, tc.addr, h.User, h.Addr)
+		}
+	}
+
+	// the port of the ssh config is kept unless it's set on the command line
+	r.opts.ClientOptions = sshconfig.ClientOptions{}
+	r.opts.SSHConfig["cache"] = sshconfig.ClientOptions{HostName: "10.0.0.3"}
+	for name, addr := range map[string]string{"web": "10.0.0.1:2222", "cache": "10.0.0.3:22"} {
+		if h, err := r.Resolve(name, 0); err != nil || h.Addr != addr {
+			t.Errorf("%s: expected %s, got %v - %v", name, addr, h, err)
+		}
+	}
+
+	if _, err := r.Resolve("a:b:c", 0); err == nil {
+		t.Error("expected an error for an invalid host")
+	}
+}
+
+func TestForEach(t *testing.T) {
+	r := &Runner{concurrency: 2}
+	names := []string{"a", "b", "c:d:e", "d"}
+	failed := errors.New("failed")
+
+	events := make(chan Event, 2*len(names))
+	errs := r.ForEach(context.Background(), names, func(ctx context.Context, h *Host) error {
+		if h.Name == "d" {
+			return failed
+		}
+		return nil
+	}, func(e Event) {
+		events <- e
+	})
+	close(events)
+
+	if len(errs) != len(names) {
+		t.Fatalf("expected %d errors, got %d", len(names), len(errs))
+	}
+	if errs[0] != nil || errs[1] != nil || errs[2] == nil || errs[3] != failed {
+		t.Errorf("unexpected errors %v", errs)
+	}
+	counts := make(map[EventType]int)
+	for e := range events {
+		counts[e.Type]++
+	}
+	if counts[HostStarted] != len(names) || counts[HostFinished] != len(names) {
+		t.Errorf("unexpected events %v", counts)
+	}
+}
+
+// writeKey writes a private key to a temporary directory and returns its path and public key.
+func writeKey(t *testing.T) (string, ssh.PublicKey) {
+	dir, err := ioutil.TempDir("", "runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	identity := filepath.Join(dir, "id_ecdsa")
+	key, err := sshtest.WriteKey(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity, key
+}
+
+// newTestRunner returns a runner authenticating with a new key and the public key.
+func newTestRunner(t *testing.T) (*Runner, ssh.PublicKey) {
+	identity, key := writeKey(t)
+	r, err := New(Options{IdentityFiles: []string{identity}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, key
+}
+
+func TestRun(t *testing.T) {
+	r, key := newTestRunner(t)
+
+	handler := func(e *sshtest.Exec) int {
+		fmt.Fprintf(e.Stdout, "%s %s %s", e.User, e.Env["GREETING"], e.Command)
+		fmt.Fprint(e.Stderr, "warning")
+		if e.Command == "fail" {
+			return 3
+		}
+		return 0
+	}
+	ok, err := sshtest.NewServer(sshtest.Config{AuthorizedKeys: []ssh.PublicKey{key}, Handler: handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ok.Close()
+	_, otherKey := writeKey(t)
+	denied, err := sshtest.NewServer(sshtest.Config{AuthorizedKeys: []ssh.PublicKey{otherKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	refused, err := sshtest.NewServer(sshtest.Config{Refuse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+
+	var (
+		mu     sync.Mutex
+		stdout = make(map[string]string)
+		stderr = make(map[string]string)
+	)
+	names := []string{ok.Addr(), denied.Addr(), refused.Addr()}
+	results := r.Run(context.Background(), names, Command{
+		Cmd: "hello",
+		Env: map[string]string{"GREETING": "hi"},
+	}, func(e Event) {
+		if e.Type != HostOutput {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if e.Stderr {
+			stderr[e.Host.Name] += string(e.Data)
+		} else {
+			stdout[e.Host.Name] += string(e.Data)
+		}
+	})
+
+	if res := results[0]; res.Err != nil || res.ExitCode != 0 {
+		t.Errorf("expected the command to succeed, got %d %v", res.ExitCode, res.Err)
+	}
+	if out := stdout[ok.Addr()]; out != "root hi hello" {
+		t.Errorf("unexpected stdout %q", out)
+	}
+	if out := stderr[ok.Addr()]; out != "warning" {
+		t.Errorf("unexpected stderr %q", out)
+	}
+	for _, res := range results[1:] {
+		if res.Err == nil || res.ExitCode != -1 || res.Host.Addr != res.Host.Name {
+			t.Errorf("expected %s to fail to connect, got %d %v", res.Host.Name, res.ExitCode, res.Err)
+		}
+	}
+
+	results = r.Run(context.Background(), names[:1], Command{Cmd: "fail"}, nil)
+	if res := results[0]; res.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %d %v", res.ExitCode, res.Err)
+	}
+	if cmds := ok.Commands(); len(cmds) != 2 || cmds[1] != "fail" {
+		t.Errorf("unexpected commands %v", cmds)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	r, _ := newTestRunner(t)
+	release := make(chan struct{})
+	s, err := sshtest.NewServer(sshtest.Config{Handler: func(e *sshtest.Exec) int {
+		<-release
+		return 0
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	results := r.Run(ctx, []string{s.Addr(), s.Addr()}, Command{Cmd: "sleep"}, nil)
+	for _, res := range results {
+		if res.Err != context.DeadlineExceeded {
+			t.Errorf("expected the command to be interrupted, got %v", res.Err)
+		}
+	}
+}
+
+func TestConnectProxyJump(t *testing.T) {
+	identity, key := writeKey(t)
+	jumpIdentity, jumpKey := writeKey(t)
+	target, err := sshtest.NewServer(sshtest.Config{AuthorizedKeys: []ssh.PublicKey{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	jump, err := sshtest.NewServer(sshtest.Config{AuthorizedKeys: []ssh.PublicKey{jumpKey}, Forwarding: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jump.Close()
+	host, port, _ := net.SplitHostPort(jump.Addr())
+
+	// the jump host is resolved through its own section of the ssh config
+	r, err := New(Options{
+		IdentityFiles: []string{identity},
+		SSHConfig: map[string]sshconfig.ClientOptions{
+			"bastion": {HostName: host, Port: port, User: "jump", IdentityFile: jumpIdentity},
+		},
+		ClientOptions: sshconfig.ClientOptions{ProxyJump: "bastion"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	h, err := r.Resolve(target.Addr(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := r.Connect(context.Background(), h)
+	if err != nil {
+		t.Fatalf("expected to connect through the jump host, got %v", err)
+	}
+	session.Close()
+	if _, err := r.ConnectIdentity(context.Background(), h, "root", jumpIdentity); err == nil {
+		t.Error("expected the target to refuse the identity of the jump host")
+	}
+}
+
+func TestHostKeys(t *testing.T) {
+	r, key := newTestRunner(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := sshtest.NewServer(sshtest.Config{HostKey: hostKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	jump, err := sshtest.NewServer(sshtest.Config{AuthorizedKeys: []ssh.PublicKey{key}, Forwarding: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jump.Close()
+
+	h, err := r.Resolve(target.Addr(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Options.ProxyJump = jump.Addr()
+	keys, err := r.HostKeys(context.Background(), h, []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0].Marshal()) != string(hostKey.PublicKey().Marshal()) {
+		t.Errorf("expected the RSA host key through the jump host, got %v", keys)
+	}
+}
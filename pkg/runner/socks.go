@@ -0,0 +1,116 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// socksConnect asks the SOCKS5 proxy on the connection to connect to addr,
+// authenticating with the username and password of the user when it's set.
+// The host of addr is resolved by the proxy unless it's an IP address.
+func socksConnect(c net.Conn, addr string, user *url.Userinfo) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name %s is too long", host)
+	}
+
+	greeting := []byte{5, 1, 0}
+	if user != nil {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err := c.Write(greeting); err != nil {
+		return err
+	}
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	switch buf[1] {
+	case 0:
+	case 2:
+		if user == nil {
+			return fmt.Errorf("socks proxy requires authentication")
+		}
+		// username and password authentication of RFC 1929
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return fmt.Errorf("socks username or password is too long")
+		}
+		auth := []byte{1, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return fmt.Errorf("socks authentication failed")
+		}
+	case 0xff:
+		// none of the offered methods is accepted
+		if user == nil {
+			return fmt.Errorf("socks proxy requires authentication")
+		}
+		return fmt.Errorf("socks proxy rejected the username and password authentication")
+	default:
+		return fmt.Errorf("socks proxy requires an unsupported authentication method")
+	}
+
+	// the address is sent as an IP address when it is one, the proxy
+	// resolves the host names
+	req := []byte{5, 1, 0}
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, 1)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(portNum>>8), byte(portNum))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return fmt.Errorf("socks proxy failed to connect to %s: reply %d", addr, buf[1])
+	}
+	// skip the bound address
+	var n int
+	switch buf[3] {
+	case 1:
+		n = 4
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	case 4:
+		n = 16
+	default:
+		return fmt.Errorf("unsupported socks address type %d", buf[3])
+	}
+	_, err = io.ReadFull(c, buf[:n+2])
+	return err
+}
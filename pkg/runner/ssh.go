@@ -0,0 +1,304 @@
+package runner
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Session stores the open session and connection to execute a command.
+type Session struct {
+	// Client is the ssh client that started the session.
+	Client *ssh.Client
+
+	// Options are the effective client options used to connect to the host.
+	Options sshconfig.ClientOptions
+
+	// proxy is the ProxyCommand the connection goes through, nil when
+	// connected directly
+	proxy *proxyCmdConn
+
+	*ssh.Session
+}
+
+// NewSession opens another session over the connection of the session.
+// Closing it only closes the new session, the connection is left open.
+func (s *Session) NewSession() (*Session, error) {
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		Client:  s.Client,
+		Options: s.Options,
+		proxy:   s.proxy,
+		Session: session,
+	}, nil
+}
+
+// Annotate adds the stderr of the ProxyCommand the connection goes through to
+// errors other than the exit status of a command, as they can be caused by the
+// proxy failing.
+func (s *Session) Annotate(err error) error {
+	if s.proxy == nil {
+		return err
+	}
+	return s.proxy.annotate(err)
+}
+
+// Close closses the open ssh session and connection.
+func (s *Session) Close() {
+	s.Session.Close()
+	s.Client.Close()
+}
+
+// sshClientConfig stores the configuration and the ssh agent to forward authentication requests
+type sshClientConfig struct {
+	// agent is the connection to the ssh agent that is forwarded to the host,
+	// it is nil when agent forwarding is disabled for the host
+	agent agent.Agent
+
+	// host to connect to
+	host string
+	// name is the host as it was specified by the user
+	name string
+	// trace records the stages of connecting to the host when it's set
+	trace *trace
+	// jumps are the jump hosts of ProxyJump connected to in turn
+	jumps []*jumpHost
+
+	*ssh.ClientConfig
+}
+
+// newSSHClientConfig initializes per-host SSH configuration.
+func newSSHClientConfig(user, host, name string, agt agent.Agent, method ssh.AuthMethod) *sshClientConfig {
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{method},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	return &sshClientConfig{
+		agent:        agt,
+		host:         host,
+		name:         name,
+		ClientConfig: config,
+	}
+}
+
+// NewSession creates a new ssh session with the host.
+// It forwards authentication to the agent when it's configured.
+func (s *sshClientConfig) NewSession(ctx context.Context, options sshconfig.ClientOptions) (*Session, error) {
+	conn, proxy, err := s.connect(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.agent != nil {
+		if err := agent.ForwardToAgent(conn, s.agent); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.agent != nil {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return &Session{
+		Client:  conn,
+		Options: options,
+		proxy:   proxy,
+		Session: session,
+	}, nil
+}
+
+// connect establishes the ssh connection with the host through the ProxyCommand,
+// or the proxy and jump hosts, of the options. The ProxyCommand is returned when
+// the connection goes through it.
+func (s *sshClientConfig) connect(ctx context.Context, options sshconfig.ClientOptions) (*ssh.Client, *proxyCmdConn, error) {
+	timeout, err := connectTimeout(options.ConnectTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !IsProxyCommand(options.ProxyCommand) {
+		conn, err := s.dial(ctx, options, timeout)
+		return conn, nil, err
+	}
+
+	proxy, err := newProxyCmdConn(s, options.ProxyCommand)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the deadline stops the handshake when the proxy is stuck
+	if timeout > 0 {
+		proxy.SetDeadline(time.Now().Add(timeout))
+	}
+	var (
+		c      net.Conn = proxy
+		config          = s.ClientConfig
+	)
+	if s.trace != nil {
+		c, config = s.trace.connected(c, config)
+	}
+	stop := closeOnDone(ctx, proxy)
+	cc, chans, reqs, err := ssh.NewClientConn(c, s.host, config)
+	stop()
+	if err != nil {
+		proxy.Close()
+		return nil, nil, proxy.annotate(err)
+	}
+	proxy.SetDeadline(time.Time{})
+	return ssh.NewClient(cc, chans, reqs), proxy, nil
+}
+
+// closeOnDone closes c when the context is done before the returned function is called.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// connectTimeout parses the ConnectTimeout option in seconds, zero means no timeout.
+func connectTimeout(value string) (time.Duration, error) {
+	if value == "" || value == "none" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid ConnectTimeout %s", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// defaultAuthMethods initializes all the available SSH authentication methods.
+// By default, it uses ~/.ssh/id_dsa, ~/.ssh/id_ecdsa, ~/.ssh/id_ed25519,
+// and ~/.ssh/id_rsa for authentication.
+func defaultAuthMethods(identityFiles []string, agt agent.Agent) map[string]ssh.AuthMethod {
+	methods := make(map[string]ssh.AuthMethod)
+
+	if len(identityFiles) == 0 {
+		u, err := user.Current()
+		if err == nil {
+			identityFiles = []string{
+				filepath.Join(u.HomeDir, ".ssh", "id_dsa"),
+				filepath.Join(u.HomeDir, ".ssh", "id_ecdsa"),
+				filepath.Join(u.HomeDir, ".ssh", "id_ed25519"),
+				filepath.Join(u.HomeDir, ".ssh", "id_rsa"),
+			}
+		}
+	}
+
+	if agt != nil {
+		if m, err := newSSHAgentAuthMethod(agt); err == nil {
+			methods["ssh-agent"] = m
+		}
+	}
+
+	for _, i := range identityFiles {
+		if m, err := newSSHPublicKeyAuthMethod(i); err == nil {
+			methods[i] = m
+		} else {
+			log.Debugf("Failed to load identity file %s", i)
+		}
+	}
+
+	return methods
+}
+
+// newSSHAgentAuthMethod creates a new SSH authentication method using SSH agent
+func newSSHAgentAuthMethod(agt agent.Agent) (ssh.AuthMethod, error) {
+	signers, err := agt.Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.PublicKeys(signers...), nil
+}
+
+// newSSHPublicKeyAuthMethod creates a new SSH authentication method using public/private key
+func newSSHPublicKeyAuthMethod(identityFile string) (ssh.AuthMethod, error) {
+	contents, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// handle plain and encrypted private key file
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode identity file %s", identityFile)
+	}
+
+	var signer ssh.Signer
+	if x509.IsEncryptedPEMBlock(block) {
+		fmt.Print("Key passphrase: ")
+		pass, err := terminal.ReadPassword(int(syscall.Stdin))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("")
+
+		block.Bytes, err = x509.DecryptPEMBlock(block, pass)
+		if err != nil {
+			return nil, err
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "DSA PRIVATE KEY":
+			key, err = ssh.ParseDSAPrivateKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("unsupported key type %q", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		signer, err = ssh.ParsePrivateKey(contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ssh.PublicKeys(signer), nil
+}
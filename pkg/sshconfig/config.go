@@ -0,0 +1,184 @@
+// Package sshconfig parses the OpenSSH client config file and options.
+package sshconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ClientOptions holds the client options for establishing SSH connection.
+// See 'man 5 ssh_config' for the option details.
+// LocalForward, RemoteForward and DynamicForward hold all the forwards of the
+// option separated by new lines as the option can be repeated.
+// ProxyURL is not an OpenSSH option, it's the SOCKS5 or HTTP proxy the host is
+// connected through, add 'IgnoreUnknown ProxyURL' to the config for ssh to ignore it.
+type ClientOptions struct {
+	ConnectTimeout       string
+	DynamicForward       string
+	ExitOnForwardFailure string
+	ForwardAgent         string
+	Host                 string
+	HostName             string
+	IdentityFile         string
+	LocalForward         string
+	Port                 string
+	ProxyCommand         string
+	ProxyJump            string
+	ProxyURL             string
+	RemoteForward        string
+	RequestTTY           string
+	User                 string
+}
+
+// ParseFile parses the file on the given file path and build a list of sections of SSH client options.
+func ParseFile(path string) (map[string]ClientOptions, error) {
+	sections := make(map[string]ClientOptions)
+
+	log.Debugf("Parsing ssh config file: %s", path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debugf("cannot find ssh config file: %s", path)
+			return sections, nil
+		}
+		return nil, err
+	}
+
+	// Read lines in reverse order and parse option for each Host section:
+	lines := strings.Split(string(content), "\n")
+	hostExpr := regexp.MustCompile("^\\s*Host\\b\\s*=?\\s*(.+)")
+
+	end := len(lines)
+	for i := end - 1; i >= 0; i-- {
+		text := lines[i]
+
+		// Skip comment lines:
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// When 'Host' option is found, parse the options of from current line to end line:
+		m := hostExpr.FindStringSubmatch(text)
+		if len(m) == 2 {
+			host := m[1]
+			sections[host] = ParseOptions(lines[i:end])
+
+			end = i // This line will be the end of the next section as we're doing reverse iteration.
+		}
+	}
+
+	return sections, nil
+}
+
+// Merge returns the merged copy of the given options from SSH client config file and CLI.
+// Note, 'User' and 'IdentityFile' SSH client options passed from '--option' are ignored, user should use '--user' and '--identity' flag accordingly.
+func Merge(configFileOptions, cliOptions ClientOptions) ClientOptions {
+	options := configFileOptions // configFileOptions is passed by value, it is safe to modify and return the copy.
+
+	if cliOptions.ForwardAgent != "" {
+		options.ForwardAgent = cliOptions.ForwardAgent
+	}
+
+	if cliOptions.HostName != "" {
+		options.HostName = cliOptions.HostName
+	}
+
+	if cliOptions.Port != "" {
+		options.Port = cliOptions.Port
+	}
+
+	if cliOptions.ProxyCommand != "" {
+		options.ProxyCommand = cliOptions.ProxyCommand
+	}
+
+	if cliOptions.RequestTTY != "" {
+		options.RequestTTY = cliOptions.RequestTTY
+	}
+
+	if cliOptions.ConnectTimeout != "" {
+		options.ConnectTimeout = cliOptions.ConnectTimeout
+	}
+
+	if cliOptions.ProxyJump != "" {
+		options.ProxyJump = cliOptions.ProxyJump
+	}
+
+	if cliOptions.ProxyURL != "" {
+		options.ProxyURL = cliOptions.ProxyURL
+	}
+
+	if cliOptions.ExitOnForwardFailure != "" {
+		options.ExitOnForwardFailure = cliOptions.ExitOnForwardFailure
+	}
+
+	return options
+}
+
+// ParseOptions converts a list of OpenSSH client options to ClientOptions.
+// Each option in the given list is a keyword-argument pair which is
+// either separated by whitespace or optional whitespace and exactly one '='.
+// Port is left empty when it's not set so that it does not override the
+// port of the ssh config, port 22 is used when no port is set at all.
+func ParseOptions(plainOpts []string) ClientOptions {
+	optionExpr := regexp.MustCompile("\\s*(\\w+)\\s*=?\\s*(.+)")
+
+	options := ClientOptions{
+		Host: "*", // Set Host pattern to "*" as default.
+	}
+	for _, i := range plainOpts {
+		m := optionExpr.FindStringSubmatch(i)
+		if len(m) != 3 {
+			continue
+		}
+		key := m[1]
+		value := m[2]
+
+		switch strings.ToLower(key) {
+		case "host":
+			options.Host = value
+		case "hostname":
+			options.HostName = value
+		case "user":
+			options.User = value
+		case "port":
+			options.Port = value
+		case "forwardagent":
+			options.ForwardAgent = value
+		case "identityfile":
+			options.IdentityFile = value
+		case "proxycommand":
+			options.ProxyCommand = value
+		case "proxyjump":
+			options.ProxyJump = value
+		case "proxyurl":
+			options.ProxyURL = value
+		case "requesttty":
+			options.RequestTTY = value
+		case "connecttimeout":
+			options.ConnectTimeout = value
+		case "localforward":
+			options.LocalForward = appendOption(options.LocalForward, value)
+		case "remoteforward":
+			options.RemoteForward = appendOption(options.RemoteForward, value)
+		case "dynamicforward":
+			options.DynamicForward = appendOption(options.DynamicForward, value)
+		case "exitonforwardfailure":
+			options.ExitOnForwardFailure = value
+		}
+	}
+
+	log.Debugf("Parsed SSH options: %v", options)
+	return options
+}
+
+// appendOption adds the value to the values of an option that can be repeated.
+func appendOption(values, value string) string {
+	if values == "" {
+		return value
+	}
+	return values + "\n" + value
+}
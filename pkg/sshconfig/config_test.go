@@ -1,4 +1,4 @@
-package main
+package sshconfig
 
 import (
 	"io/ioutil"
@@ -7,7 +7,7 @@ import (
 )
 
 func TestParseOptions(t *testing.T) {
-	verify := func(fmt string, exp, out SSHClientOptions) {
+	verify := func(fmt string, exp, out ClientOptions) {
 		if exp != out {
 			t.Errorf("Could not parse option - format: %s, expected: %q, output: %q.", fmt, exp, out)
 		}
@@ -17,7 +17,7 @@ func TestParseOptions(t *testing.T) {
 	{
 		fmt := "<keyword> <argument>"
 		in := []string{"Host 127.0.0.1", "Port 22"}
-		exp := SSHClientOptions{
+		exp := ClientOptions{
 			Host: "127.0.0.1",
 			Port: "22",
 		}
@@ -30,7 +30,7 @@ func TestParseOptions(t *testing.T) {
 	{
 		fmt := "<keyword>=<argument>"
 		in := []string{"Host=127.0.0.1", "Port=22"}
-		exp := SSHClientOptions{
+		exp := ClientOptions{
 			Host: "127.0.0.1",
 			Port: "22",
 		}
@@ -43,7 +43,7 @@ func TestParseOptions(t *testing.T) {
 	{
 		fmt := "<keyword> = <argument>"
 		in := []string{"Host = 127.0.0.1", "Port = 22"}
-		exp := SSHClientOptions{
+		exp := ClientOptions{
 			Host: "127.0.0.1",
 			Port: "22",
 		}
@@ -56,7 +56,7 @@ func TestParseOptions(t *testing.T) {
 	{
 		fmt := "<keyword><tab><argument>"
 		in := []string{"Host	127.0.0.1", "Port	22"}
-		exp := SSHClientOptions{
+		exp := ClientOptions{
 			Host: "127.0.0.1",
 			Port: "22",
 		}
@@ -66,8 +66,8 @@ func TestParseOptions(t *testing.T) {
 	}
 }
 
-func TestParseSSHConfigFile(t *testing.T) {
-	verify := func(content string, exp, out map[string]SSHClientOptions) {
+func TestParseFile(t *testing.T) {
+	verify := func(content string, exp, out map[string]ClientOptions) {
 		if len(exp) != len(out) {
 			t.Errorf("Some sections are not parsed - content: %q, expected: %q, output: %q.", content, exp, out)
 		}
@@ -92,8 +92,8 @@ func TestParseSSHConfigFile(t *testing.T) {
 	{
 		in := "# <blank>"
 		ioutil.WriteFile(f.Name(), []byte(in), 0644)
-		exp := map[string]SSHClientOptions{}
-		out, _ := ParseSSHConfigFile(f.Name())
+		exp := map[string]ClientOptions{}
+		out, _ := ParseFile(f.Name())
 
 		verify(in, exp, out)
 	}
@@ -105,13 +105,12 @@ Host github.com
   User github
 `
 		ioutil.WriteFile(f.Name(), []byte(in), 0644)
-		exp := map[string]SSHClientOptions{}
-		exp["github.com"] = SSHClientOptions{
+		exp := map[string]ClientOptions{}
+		exp["github.com"] = ClientOptions{
 			Host: "github.com",
-			Port: "22",
 			User: "github",
 		}
-		out, _ := ParseSSHConfigFile(f.Name())
+		out, _ := ParseFile(f.Name())
 
 		verify(in, exp, out)
 	}
@@ -126,18 +125,16 @@ Host bitbucket.com
   User bitbucket
 `
 		ioutil.WriteFile(f.Name(), []byte(in), 0644)
-		exp := map[string]SSHClientOptions{}
-		exp["github.com"] = SSHClientOptions{
+		exp := map[string]ClientOptions{}
+		exp["github.com"] = ClientOptions{
 			Host: "github.com",
-			Port: "22",
 			User: "github",
 		}
-		exp["bitbucket.com"] = SSHClientOptions{
+		exp["bitbucket.com"] = ClientOptions{
 			Host: "bitbucket.com",
-			Port: "22",
 			User: "bitbucket",
 		}
-		out, _ := ParseSSHConfigFile(f.Name())
+		out, _ := ParseFile(f.Name())
 
 		verify(in, exp, out)
 	}
@@ -149,16 +146,14 @@ Host github.com
 Host bitbucket.com
 `
 		ioutil.WriteFile(f.Name(), []byte(in), 0644)
-		exp := map[string]SSHClientOptions{}
-		exp["github.com"] = SSHClientOptions{
+		exp := map[string]ClientOptions{}
+		exp["github.com"] = ClientOptions{
 			Host: "github.com",
-			Port: "22",
 		}
-		exp["bitbucket.com"] = SSHClientOptions{
+		exp["bitbucket.com"] = ClientOptions{
 			Host: "bitbucket.com",
-			Port: "22",
 		}
-		out, _ := ParseSSHConfigFile(f.Name())
+		out, _ := ParseFile(f.Name())
 
 		verify(in, exp, out)
 	}
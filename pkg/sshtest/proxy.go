@@ -0,0 +1,292 @@
+package sshtest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Proxy is a SOCKS5 or HTTP CONNECT proxy listening on localhost.
+type Proxy struct {
+	// User and Password are required from the clients when User is set
+	User     string
+	Password string
+
+	listener net.Listener
+	http     bool
+
+	mu sync.Mutex
+	// targets are the addresses requested by the clients
+	targets []string
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+// NewSOCKS5Proxy starts a SOCKS5 proxy on a free port of localhost, it requires the
+// username and password authentication of RFC 1929 when user is not empty.
+func NewSOCKS5Proxy(user, password string) (*Proxy, error) {
+	return newProxy(user, password, false)
+}
+
+// NewHTTPProxy starts an HTTP proxy supporting the CONNECT method on a free port of
+// localhost, it requires basic authentication when user is not empty.
+func NewHTTPProxy(user, password string) (*Proxy, error) {
+	return newProxy(user, password, true)
+}
+
+func newProxy(user, password string, http bool) (*Proxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		User:     user,
+		Password: password,
+		listener: l,
+		http:     http,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	p.wg.Add(1)
+	go p.serve()
+	return p, nil
+}
+
+// Addr returns the host:port address the proxy listens on.
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Targets returns the addresses the clients asked to connect to, as they were
+// sent by the clients, in the order they were received.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// Close stops listening and closes the open connections.
+func (p *Proxy) Close() error {
+	err := p.listener.Close()
+	p.mu.Lock()
+	for c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.conns[c] = struct{}{}
+		p.wg.Add(1)
+		p.mu.Unlock()
+
+		go func() {
+			defer p.wg.Done()
+			p.handle(c)
+			p.mu.Lock()
+			delete(p.conns, c)
+			p.mu.Unlock()
+		}()
+	}
+}
+
+func (p *Proxy) handle(c net.Conn) {
+	defer c.Close()
+	if p.http {
+		p.handleHTTP(c)
+	} else {
+		p.handleSOCKS5(c)
+	}
+}
+
+func (p *Proxy) connect(addr string) (net.Conn, error) {
+	p.mu.Lock()
+	p.targets = append(p.targets, addr)
+	p.mu.Unlock()
+	return net.Dial("tcp", addr)
+}
+
+// handleHTTP serves a CONNECT request. The start of the output of the target
+// is sent with the response so that clients must not drop what they read past it.
+func (p *Proxy) handleHTTP(c net.Conn) {
+	r := bufio.NewReader(c)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		fmt.Fprint(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if p.User != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.User + ":" + p.Password))
+		if req.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			fmt.Fprint(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+	}
+	target, err := p.connect(req.Host)
+	if err != nil {
+		fmt.Fprint(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+
+	buf := make([]byte, 4096)
+	n, err := target.Read(buf)
+	if err != nil {
+		fmt.Fprint(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	if _, err := c.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), buf[:n]...)); err != nil {
+		return
+	}
+	pipeConns(&readerConn{Conn: c, r: r}, target)
+}
+
+// readerConn reads what the bufio.Reader of the request buffered first.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (p *Proxy) handleSOCKS5(c net.Conn) {
+	buf := make([]byte, 258)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	method := byte(0)
+	if p.User != "" {
+		method = 2
+	}
+	supported := false
+	for _, m := range methods {
+		supported = supported || m == method
+	}
+	if !supported {
+		c.Write([]byte{5, 0xff})
+		return
+	}
+	if _, err := c.Write([]byte{5, method}); err != nil {
+		return
+	}
+	if method == 2 && !p.authenticate(c) {
+		return
+	}
+
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return
+	}
+	if buf[1] != 1 {
+		c.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if buf[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return
+		}
+		name := make([]byte, buf[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		c.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	target, err := p.connect(addr)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	if _, err := c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	pipeConns(c, target)
+}
+
+// authenticate checks the username and password of RFC 1929 sent by the client.
+func (p *Proxy) authenticate(c net.Conn) bool {
+	field := func() (string, error) {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(c, n); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		_, err := io.ReadFull(c, b)
+		return string(b), err
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(c, version); err != nil || version[0] != 1 {
+		return false
+	}
+	user, err := field()
+	if err != nil {
+		return false
+	}
+	password, err := field()
+	if err != nil {
+		return false
+	}
+	if user != p.User || password != p.Password {
+		c.Write([]byte{1, 1})
+		return false
+	}
+	_, err = c.Write([]byte{1, 0})
+	return err == nil
+}
+
+// pipeConns copies between the connections until one of them is closed.
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,535 @@
+// Package sshtest runs SSH servers in the process so that code connecting to
+// hosts over SSH can be tested without real hosts.
+package sshtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Exec is a command executed on a server.
+type Exec struct {
+	// Command is the command as it was sent by the client
+	Command string
+	// User is the user the client authenticated as
+	User string
+	// Env are the environment variables set by the client
+	Env map[string]string
+	// Pty is true when the client requested a pseudo terminal
+	Pty bool
+	// Term and Size are the terminal type and the size of the pseudo terminal
+	Term string
+	Size WindowSize
+	// WindowChanges receives the sizes the pseudo terminal is changed to while
+	// the command runs
+	WindowChanges <-chan WindowSize
+	// Signals receives the signals sent by the client while the command runs
+	Signals <-chan ssh.Signal
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+}
+
+// WindowSize is the size of a pseudo terminal in characters.
+type WindowSize struct {
+	Width, Height int
+}
+
+// Handler executes a command and returns its exit code. A negative exit code
+// closes the session without an exit status, as if the connection was lost.
+type Handler func(e *Exec) int
+
+// Config configures a server.
+type Config struct {
+	// HostKey is the key of the server, a key is generated when it's nil
+	HostKey ssh.Signer
+	// AuthorizedKeys are the keys accepted for public key authentication,
+	// any key is accepted when it's empty
+	AuthorizedKeys []ssh.PublicKey
+	// Handler executes the commands, they are executed with sh -c when it's nil
+	Handler Handler
+	// Latency delays the handshake and every command
+	Latency time.Duration
+	// Refuse closes every connection before the handshake
+	Refuse bool
+	// SFTP serves the sftp subsystem
+	SFTP bool
+	// Forwarding allows local and remote port forwarding through the server
+	Forwarding bool
+}
+
+// Server is an SSH server listening on localhost.
+type Server struct {
+	config   Config
+	ssh      *ssh.ServerConfig
+	listener net.Listener
+
+	mu       sync.Mutex
+	commands []string
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server on a free port of localhost.
+func NewServer(config Config) (*Server, error) {
+	if config.Handler == nil {
+		config.Handler = ShellHandler
+	}
+	if config.HostKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if config.HostKey, err = ssh.NewSignerFromKey(key); err != nil {
+			return nil, err
+		}
+	}
+	s := &Server{
+		config: config,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	s.ssh = &ssh.ServerConfig{
+		PublicKeyCallback: s.authKey,
+	}
+	s.ssh.AddHostKey(config.HostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.listener = l
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// NewServers starts n servers with the same config, they are all closed when
+// starting one of them fails.
+func NewServers(n int, config Config) ([]*Server, error) {
+	servers := make([]*Server, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := NewServer(config)
+		if err != nil {
+			for _, s := range servers {
+				s.Close()
+			}
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// Addr returns the host:port address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// HostKey returns the public key of the server.
+func (s *Server) HostKey() ssh.PublicKey {
+	return s.config.HostKey.PublicKey()
+}
+
+// Commands returns the commands executed on the server in the order they were received.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Close stops listening and closes the open connections, it waits for the
+// handlers of the commands still running to return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) authKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if len(s.config.AuthorizedKeys) == 0 {
+		return nil, nil
+	}
+	for _, k := range s.config.AuthorizedKeys {
+		if k.Type() == key.Type() && string(k.Marshal()) == string(key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %s", meta.User())
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if s.config.Refuse {
+			c.Close()
+			continue
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	defer c.Close()
+	time.Sleep(s.config.Latency)
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, s.ssh)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go s.handleGlobalRequests(conn, reqs)
+
+	var wg sync.WaitGroup
+	for nc := range chans {
+		switch {
+		case nc.ChannelType() == "session":
+			ch, creqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleSession(conn.User(), ch, creqs)
+			}()
+		case nc.ChannelType() == "direct-tcpip" && s.config.Forwarding:
+			go handleDirect(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type "+nc.ChannelType())
+		}
+	}
+	wg.Wait()
+}
+
+func (s *Server) handleSession(user string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	e := &Exec{
+		User:   user,
+		Env:    make(map[string]string),
+		Stdin:  ch,
+		Stdout: ch,
+		Stderr: ch.Stderr(),
+	}
+	for r := range reqs {
+		switch r.Type {
+		case "env":
+			var kv struct{ Key, Value string }
+			if err := ssh.Unmarshal(r.Payload, &kv); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			e.Env[kv.Key] = kv.Value
+			r.Reply(true, nil)
+		case "pty-req":
+			var p struct {
+				Term          string
+				Width, Height uint32
+				PixelWidth    uint32
+				PixelHeight   uint32
+				Modes         string
+			}
+			if err := ssh.Unmarshal(r.Payload, &p); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			e.Pty, e.Term = true, p.Term
+			e.Size = WindowSize{Width: int(p.Width), Height: int(p.Height)}
+			r.Reply(true, nil)
+		case "window-change":
+			if size, ok := parseWindowChange(r.Payload); ok {
+				e.Size = size
+			}
+			if r.WantReply {
+				r.Reply(true, nil)
+			}
+		case "auth-agent-req@openssh.com", "signal":
+			r.Reply(r.Type != "signal", nil)
+		case "subsystem":
+			var p struct{ Name string }
+			ssh.Unmarshal(r.Payload, &p)
+			if p.Name != "sftp" || !s.config.SFTP {
+				r.Reply(false, nil)
+				continue
+			}
+			r.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		case "exec":
+			var p struct{ Command string }
+			if err := ssh.Unmarshal(r.Payload, &p); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			r.Reply(true, nil)
+			e.Command = p.Command
+			s.mu.Lock()
+			s.commands = append(s.commands, p.Command)
+			s.mu.Unlock()
+
+			// the remaining requests, i.e. signals, are answered while the command runs
+			signals := make(chan ssh.Signal, 1)
+			windowChanges := make(chan WindowSize, 8)
+			e.Signals, e.WindowChanges = signals, windowChanges
+			go handleRunning(reqs, signals, windowChanges)
+			time.Sleep(s.config.Latency)
+			code := s.config.Handler(e)
+			if code < 0 {
+				return
+			}
+			ch.CloseWrite()
+			status := make([]byte, 4)
+			binary.BigEndian.PutUint32(status, uint32(code))
+			ch.SendRequest("exit-status", false, status)
+			return
+		default:
+			r.Reply(false, nil)
+		}
+	}
+}
+
+// handleRunning passes the signals and the window changes sent while the command
+// runs to the handler, they are dropped when the handler is not receiving them.
+func handleRunning(reqs <-chan *ssh.Request, signals chan<- ssh.Signal, windowChanges chan<- WindowSize) {
+	for r := range reqs {
+		ok := false
+		switch r.Type {
+		case "signal":
+			var p struct{ Name string }
+			if err := ssh.Unmarshal(r.Payload, &p); err == nil {
+				select {
+				case signals <- ssh.Signal(p.Name):
+				default:
+				}
+			}
+		case "window-change":
+			var size WindowSize
+			if size, ok = parseWindowChange(r.Payload); ok {
+				select {
+				case windowChanges <- size:
+				default:
+				}
+			}
+		}
+		if r.WantReply {
+			r.Reply(ok, nil)
+		}
+	}
+}
+
+// parseWindowChange returns the size of the payload of a window-change request.
+func parseWindowChange(payload []byte) (WindowSize, bool) {
+	var p struct {
+		Width, Height uint32
+		PixelWidth    uint32
+		PixelHeight   uint32
+	}
+	if err := ssh.Unmarshal(payload, &p); err != nil {
+		return WindowSize{}, false
+	}
+	return WindowSize{Width: int(p.Width), Height: int(p.Height)}, true
+}
+
+// handleGlobalRequests serves remote port forwarding requests when forwarding is enabled.
+func (s *Server) handleGlobalRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for r := range reqs {
+		if r.Type != "tcpip-forward" || !s.config.Forwarding {
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+			continue
+		}
+		var p struct {
+			Addr string
+			Port uint32
+		}
+		if err := ssh.Unmarshal(r.Payload, &p); err != nil {
+			r.Reply(false, nil)
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(p.Addr, strconv.Itoa(int(p.Port))))
+		if err != nil {
+			r.Reply(false, nil)
+			continue
+		}
+		listeners = append(listeners, l)
+		port := uint32(l.Addr().(*net.TCPAddr).Port)
+		reply := make([]byte, 4)
+		binary.BigEndian.PutUint32(reply, port)
+		r.Reply(true, reply)
+		go forwardRemote(conn, l, p.Addr, port)
+	}
+}
+
+func forwardRemote(conn *ssh.ServerConn, l net.Listener, addr string, port uint32) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		origin := c.RemoteAddr().(*net.TCPAddr)
+		ch, reqs, err := conn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{addr, port, origin.IP.String(), uint32(origin.Port)}))
+		if err != nil {
+			c.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go pipe(ch, c)
+	}
+}
+
+func handleDirect(nc ssh.NewChannel) {
+	var p struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &p); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort(p.Host, strconv.Itoa(int(p.Port))))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		c.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, c)
+}
+
+// pipe copies between the channel and the connection until both directions are done.
+func pipe(ch ssh.Channel, c net.Conn) {
+	done := make(chan struct{}, 1)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	io.Copy(c, ch)
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	<-done
+	ch.Close()
+	c.Close()
+}
+
+// ShellHandler executes the command with sh -c on the local machine with the
+// environment of the process and the variables set by the client. The signals
+// sent by the client are sent to the process group of the shell, as the shell
+// may not pass them to the command it started.
+func ShellHandler(e *Exec) int {
+	cmd := exec.Command("sh", "-c", e.Command)
+	cmd.Env = os.Environ()
+	for k, v := range e.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = e.Stdin, e.Stdout, e.Stderr
+	newProcessGroup(cmd)
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case sig := <-e.Signals:
+					signalGroup(cmd, sig)
+				case <-done:
+					return
+				}
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintln(e.Stderr, err)
+		return 127
+	}
+	return 0
+}
+
+// WriteKey generates a private key, writes it to the file in the PEM format
+// read by ssh clients and returns its public key.
+func WriteKey(path string) (ssh.PublicKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(&key.PublicKey)
+}
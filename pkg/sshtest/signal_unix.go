@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package sshtest
+
+import (
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// shellSignals are the signals sent by clients that are passed to the commands
+// executed by ShellHandler.
+var shellSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGTERM: syscall.SIGTERM,
+}
+
+// newProcessGroup makes the command start in its own process group.
+func newProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends the signal to the process group of the started command.
+func signalGroup(cmd *exec.Cmd, sig ssh.Signal) {
+	if s, ok := shellSignals[sig]; ok {
+		syscall.Kill(-cmd.Process.Pid, s)
+	}
+}
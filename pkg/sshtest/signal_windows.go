@@ -0,0 +1,17 @@
+package sshtest
+
+import (
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newProcessGroup does nothing on windows, there are no process groups to signal.
+func newProcessGroup(cmd *exec.Cmd) {}
+
+// signalGroup only supports SIGKILL on windows, which kills the started command.
+func signalGroup(cmd *exec.Cmd, sig ssh.Signal) {
+	if sig == ssh.SIGKILL {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/urfave/cli"
+)
+
+// cliSources returns the flags the SSH client options of the command line were
+// set with, keyed by option name, so that the plan can explain where values come from.
+func cliSources(context *cli.Context, plainOpts []string) map[string]string {
+	sources := map[string]string{
+		"User":     "default",
+		"Port":     "default",
+		"Identity": "default",
+	}
+	keys := map[string]string{
+		"hostname":       "HostName",
+		"port":           "Port",
+		"forwardagent":   "ForwardAgent",
+		"proxycommand":   "ProxyCommand",
+		"requesttty":     "RequestTTY",
+		"connecttimeout": "ConnectTimeout",
+		"proxyjump":      "ProxyJump",
+		"proxyurl":       "ProxyURL",
+	}
+	optionExpr := regexp.MustCompile("\\s*(\\w+)\\s*=?\\s*(.+)")
+	for _, o := range plainOpts {
+		m := optionExpr.FindStringSubmatch(o)
+		if len(m) != 3 {
+			continue
+		}
+		if key, ok := keys[strings.ToLower(m[1])]; ok {
+			sources[key] = "-o " + key
+		}
+	}
+	if context.GlobalIsSet("user") {
+		sources["User"] = "--user"
+	}
+	if context.GlobalString("identity") != "" {
+		sources["Identity"] = "--identity"
+	}
+	switch {
+	case context.GlobalBool("agent"):
+		sources["Agent"] = "-A"
+		if sources["ForwardAgent"] == "" {
+			sources["ForwardAgent"] = "-A"
+		}
+	case context.GlobalBool("use-agent"):
+		sources["Agent"] = "--use-agent"
+	}
+	if context.GlobalBool("tty") && sources["RequestTTY"] == "" {
+		sources["RequestTTY"] = "-t"
+	}
+	if context.GlobalString("proxy") != "" && sources["ProxyURL"] == "" {
+		sources["ProxyURL"] = "--proxy"
+	}
+	return sources
+}
+
+// plan writes how each host is connected to and the command executed on it, with
+// where each value comes from, without connecting to the hosts.
+func (m *multiplexer) plan(w io.Writer, c command) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	for i, host := range m.hosts {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintln(tw, host)
+		row := func(key, value, source string) {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", key, value, source)
+		}
+
+		j := m.newJob(host, i)
+		h, err := m.runner.Resolve(host, i)
+		if err != nil {
+			row("error", err.Error(), "")
+			continue
+		}
+		j.host, j.user = h.Addr, h.User
+		options := h.Options
+		data := m.hostData(j, c)
+
+		// the source of an option set in the Host section of the ssh config
+		// unless it's overridden by the command line, default when unset
+		section := m.sections[host]
+		sectionSource := "ssh config Host " + host
+		source := func(key, cliValue, configValue string) string {
+			switch {
+			case cliValue != "":
+				return m.sources[key]
+			case configValue != "":
+				return sectionSource
+			}
+			return "default"
+		}
+
+		addrSource := "host"
+		if options.HostName != "" {
+			addrSource = source("HostName", m.cliOptions.HostName, section.HostName)
+		}
+		row("address", data.Addr, addrSource)
+
+		// the port of the host is used unless the host name comes from the options
+		portSource := "host"
+		if options.HostName != "" {
+			portSource = source("Port", m.cliOptions.Port, section.Port)
+		} else if _, _, err := net.SplitHostPort(host); err != nil {
+			portSource = "default"
+		}
+		row("port", data.Port, portSource)
+
+		userSource := m.sources["User"]
+		if options.User != "" {
+			userSource = sectionSource
+		}
+		row("user", data.User, userSource)
+
+		key := "identities"
+		if options.IdentityFile != "" {
+			row(key, options.IdentityFile, sectionSource)
+			key = ""
+		}
+		for _, k := range m.runner.Identities() {
+			if k == "ssh-agent" {
+				row(key, k, m.sources["Agent"])
+			} else {
+				row(key, k, m.sources["Identity"])
+			}
+			key = ""
+		}
+		if key != "" {
+			row(key, "none", "")
+		}
+
+		switch {
+		case runner.IsProxyCommand(options.ProxyCommand):
+			row("proxy", runner.ExpandProxyCommand(options.ProxyCommand, data.Addr, data.Port, data.User, host), source("ProxyCommand", m.cliOptions.ProxyCommand, section.ProxyCommand))
+		case options.ProxyCommand != "":
+			row("proxy", "none", source("ProxyCommand", m.cliOptions.ProxyCommand, section.ProxyCommand))
+		default:
+			if options.ProxyURL != "" && options.ProxyURL != "none" {
+				row("proxy", runner.RedactURL(options.ProxyURL), source("ProxyURL", m.cliOptions.ProxyURL, section.ProxyURL))
+			} else {
+				row("proxy", "none", "")
+			}
+			for _, jump := range runner.JumpHosts(options.ProxyJump) {
+				row("jump", jump, source("ProxyJump", m.cliOptions.ProxyJump, section.ProxyJump))
+			}
+		}
+		if options.ConnectTimeout != "" {
+			row("connect timeout", options.ConnectTimeout, source("ConnectTimeout", m.cliOptions.ConnectTimeout, section.ConnectTimeout))
+		}
+		if options.ForwardAgent != "" {
+			row("forward agent", options.ForwardAgent, source("ForwardAgent", m.cliOptions.ForwardAgent, section.ForwardAgent))
+		}
+		if requestTTY(options, false) {
+			row("tty", options.RequestTTY, source("RequestTTY", m.cliOptions.RequestTTY, section.RequestTTY))
+		}
+
+		forwards, err := parseForwardOptions(options)
+		if err != nil {
+			row("error", err.Error(), "")
+			continue
+		}
+		for _, f := range forwards {
+			row("forward", f.String(), sectionSource)
+		}
+		for _, f := range m.forwards {
+			row("forward", f.String(), "-"+f.kind)
+		}
+
+		env := make([]string, 0, len(c.Env))
+		for k, v := range c.Env {
+			env = append(env, k+"="+v)
+		}
+		sort.Strings(env)
+		for n, e := range env {
+			key := ""
+			if n == 0 {
+				key = "env"
+			}
+			row(key, e, "--env")
+		}
+
+		hc, err := c.forHost(data)
+		if err != nil {
+			row("error", err.Error(), "")
+			continue
+		}
+		if len(hc.Steps) == 0 {
+			row("command", hc.final(hc.Cmd), "")
+			continue
+		}
+		for n, step := range hc.Steps {
+			row(fmt.Sprintf("step %d", n+1), hc.final(step), "")
+		}
+	}
+	return tw.Flush()
+}
+
+// final returns the command line executed on the host for cmd.
+func (c command) final(cmd string) string {
+	if c.Become != nil {
+		return c.Become.wrap(cmd, false)
+	}
+	return cmd
+}
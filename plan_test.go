@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	"github.com/crosbymichael/slex/pkg/sshtest"
+)
+
+// planRows returns the rows of the plan of each host, keyed by host and row name,
+// with the value and the source separated by single spaces.
+func planRows(out string) map[string]map[string]string {
+	rows := make(map[string]map[string]string)
+	var host string
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			host = line
+			rows[host] = make(map[string]string)
+			continue
+		}
+		fields := strings.Split(strings.TrimSpace(line), "  ")
+		var cols []string
+		for _, f := range fields {
+			if f = strings.TrimSpace(f); f != "" {
+				cols = append(cols, f)
+			}
+		}
+		rows[host][cols[0]] = strings.Join(cols[1:], " ")
+	}
+	return rows
+}
+
+func TestPlan(t *testing.T) {
+	identity := filepath.Join(t.TempDir(), "id_ecdsa")
+	if _, err := sshtest.WriteKey(identity); err != nil {
+		t.Fatal(err)
+	}
+	sections := map[string]sshconfig.ClientOptions{
+		"web":    {Host: "web", HostName: "10.0.0.1", User: "deploy"},
+		"api":    {Host: "api", HostName: "10.0.0.2", Port: "2222", ProxyJump: "bastion"},
+		"worker": {Host: "worker", ConnectTimeout: "5"},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		options []string
+		sources map[string]string
+		// expected rows by host
+		expected map[string]map[string]string
+	}{
+		{
+			name: "ssh config",
+			expected: map[string]map[string]string{
+				"web": {
+					"address": "10.0.0.1 ssh config Host web",
+					"port":    "22 default",
+					"user":    "deploy ssh config Host web",
+				},
+				"api": {
+					"address": "10.0.0.2 ssh config Host api",
+					"port":    "2222 ssh config Host api",
+					"user":    "root default",
+					"jump":    "bastion ssh config Host api",
+				},
+				"worker": {
+					"address":         "worker host",
+					"port":            "22 default",
+					"connect timeout": "5 ssh config Host worker",
+				},
+				"10.0.0.9:2201": {
+					"address": "10.0.0.9 host",
+					"port":    "2201 host",
+					"proxy":   "none",
+				},
+			},
+		},
+		{
+			name:    "command line",
+			options: []string{"Port 2200", "ProxyJump gateway", "ConnectTimeout=10"},
+			sources: map[string]string{"Port": "-o Port", "ProxyJump": "-o ProxyJump", "ConnectTimeout": "-o ConnectTimeout"},
+			expected: map[string]map[string]string{
+				"web": {
+					"port": "2200 -o Port",
+					"jump": "gateway -o ProxyJump",
+				},
+				"api": {
+					"port": "2200 -o Port",
+					"jump": "gateway -o ProxyJump",
+				},
+				"worker": {
+					"port":            "22 default",
+					"connect timeout": "10 -o ConnectTimeout",
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cliOptions := sshconfig.ParseOptions(tc.options)
+			r, err := runner.New(runner.Options{
+				IdentityFiles: []string{identity},
+				SSHConfig:     sections,
+				ClientOptions: cliOptions,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			sources := map[string]string{"User": "default", "Port": "default", "Identity": "--identity"}
+			for k, v := range tc.sources {
+				sources[k] = v
+			}
+			m := &multiplexer{
+				hosts:      []string{"web", "api", "worker", "10.0.0.9:2201"},
+				sections:   sections,
+				cliOptions: cliOptions,
+				sources:    sources,
+				runner:     r,
+			}
+
+			var out bytes.Buffer
+			if err := m.plan(&out, command{Cmd: "uptime"}); err != nil {
+				t.Fatal(err)
+			}
+			rows := planRows(out.String())
+			for host, expected := range tc.expected {
+				for key, value := range expected {
+					if got := rows[host][key]; got != value {
+						t.Errorf("%s %s: expected %q, got %q in:\n%s", host, key, value, got, out.String())
+					}
+				}
+				if got := rows[host]["identities"]; got != identity+" --identity" {
+					t.Errorf("%s: unexpected identities %q", host, got)
+				}
+				if got := rows[host]["command"]; got != "uptime" {
+					t.Errorf("%s: unexpected command %q", host, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+var putCommand = cli.Command{
+	Name:      "put",
+	Usage:     "upload a file or directory to all hosts",
+	ArgsUsage: "LOCAL REMOTE",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "owner",
+			Usage: "change the owner of the uploaded files to user[:group]",
+		},
+		cli.BoolFlag{
+			Name:  "scp",
+			Usage: "upload with the scp protocol instead of sftp",
+		},
+	},
+	Action: putAction,
+}
+
+// putAction uploads the local file or directory to the remote path on all hosts.
+func putAction(context *cli.Context) error {
+	if context.NArg() != 2 {
+		return fmt.Errorf("LOCAL and REMOTE paths must be specified")
+	}
+	local, remote := context.Args().Get(0), context.Args().Get(1)
+	if _, err := os.Stat(local); err != nil {
+		return err
+	}
+
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	p := &putter{
+		local:  local,
+		remote: remote,
+		owner:  context.String("owner"),
+	}
+	forceSCP := context.Bool("scp")
+	if _, err := m.run(func(_ gocontext.Context, j *job, session *runner.Session) error {
+		u, err := newUploader(session.Client, forceSCP)
+		if err != nil {
+			return err
+		}
+		defer u.Close()
+		return p.put(j, u, session.Client)
+	}); err != nil {
+		return err
+	}
+
+	log.Debugf("finished uploading %s to all hosts", local)
+	return nil
+}
+
+// uploader writes files and directories on the remote host.
+type uploader interface {
+	// isDir returns true when the remote path is an existing directory
+	isDir(p string) (bool, error)
+	// mkdir creates the remote directory and its parents with the given mode
+	mkdir(p string, mode os.FileMode) error
+	// upload writes size bytes read from r to the remote path
+	upload(r io.Reader, size int64, mode os.FileMode, p string) error
+	chmod(p string, mode os.FileMode) error
+	rename(from, to string) error
+	remove(p string) error
+	Close() error
+}
+
+// newUploader returns an uploader using the sftp subsystem of the host,
+// falling back to scp when the subsystem is not available.
+func newUploader(client *ssh.Client, forceSCP bool) (uploader, error) {
+	if !forceSCP {
+		c, err := sftp.NewClient(client)
+		if err == nil {
+			return &sftpUploader{client: c}, nil
+		}
+		log.Debugf("sftp is not available, falling back to scp - %v", err)
+	}
+	return &scpUploader{client}, nil
+}
+
+// putter uploads a local path to a remote path.
+type putter struct {
+	local  string
+	remote string
+	owner  string
+}
+
+func (p *putter) put(j *job, u uploader, client *ssh.Client) error {
+	info, err := os.Stat(p.local)
+	if err != nil {
+		return err
+	}
+
+	// Like cp, the local path is copied inside the remote path
+	// when the remote path is a directory.
+	target := p.remote
+	isDir, err := u.isDir(target)
+	if err != nil {
+		return err
+	}
+	if isDir || strings.HasSuffix(target, "/") {
+		target = path.Join(target, filepath.Base(p.local))
+	}
+
+	if !info.IsDir() {
+		return p.putFile(j, u, client, p.local, info, target)
+	}
+	return filepath.Walk(p.local, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p.local, local)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(target, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			if err := u.mkdir(remote, info.Mode()); err != nil {
+				return err
+			}
+			return p.chown(client, remote)
+		case info.Mode().IsRegular():
+			return p.putFile(j, u, client, local, info, remote)
+		default:
+			log.Debugf("skipping %s, not a regular file", local)
+			return nil
+		}
+	})
+}
+
+// putFile uploads the local file next to the remote path and renames
+// it into place once the content, mode and owner are set.
+func (p *putter) putFile(j *job, u uploader, client *ssh.Client, local string, info os.FileInfo, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp := tempName(remote)
+	r := newProgressReader(f, j, path.Base(remote), info.Size())
+	if err := u.upload(r, info.Size(), info.Mode(), tmp); err != nil {
+		u.remove(tmp)
+		return err
+	}
+	// chown clears the setuid and setgid bits so the mode is set afterwards
+	if err := p.chown(client, tmp); err != nil {
+		u.remove(tmp)
+		return err
+	}
+	if err := u.chmod(tmp, info.Mode()); err != nil {
+		u.remove(tmp)
+		return err
+	}
+	if err := u.rename(tmp, remote); err != nil {
+		u.remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (p *putter) chown(client *ssh.Client, remote string) error {
+	if p.owner == "" {
+		return nil
+	}
+	return runRemote(client, fmt.Sprintf("chown %s %s", shellQuote(p.owner), shellQuote(remote)))
+}
+
+// sftpUploader uploads files with the sftp subsystem of the host.
+type sftpUploader struct {
+	client *sftp.Client
+	// exclusive fails the upload when the remote path exists instead of replacing it
+	exclusive bool
+}
+
+func (u *sftpUploader) isDir(p string) (bool, error) {
+	info, err := u.client.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (u *sftpUploader) mkdir(p string, mode os.FileMode) error {
+	if err := u.client.MkdirAll(p); err != nil {
+		return err
+	}
+	return u.client.Chmod(p, os.FileMode(unixMode(mode)))
+}
+
+func (u *sftpUploader) upload(r io.Reader, size int64, mode os.FileMode, p string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if u.exclusive {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	f, err := u.client.OpenFile(p, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (u *sftpUploader) chmod(p string, mode os.FileMode) error {
+	return u.client.Chmod(p, os.FileMode(unixMode(mode)))
+}
+
+// rename atomically replaces the remote path with the posix-rename extension
+// of OpenSSH, plain sftp rename fails when the new path exists.
+func (u *sftpUploader) rename(from, to string) error {
+	if err := u.client.PosixRename(from, to); err != nil {
+		log.Debugf("posix-rename failed, falling back to rename - %v", err)
+		if err := u.client.Remove(to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return u.client.Rename(from, to)
+	}
+	return nil
+}
+
+func (u *sftpUploader) remove(p string) error {
+	return u.client.Remove(p)
+}
+
+func (u *sftpUploader) Close() error {
+	return u.client.Close()
+}
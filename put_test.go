@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crosbymichael/slex/pkg/sshtest"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestClient returns a client connected to a server of the tests started with the config.
+func newTestClient(t *testing.T, config sshtest.Config) *ssh.Client {
+	s, err := sshtest.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", s.Addr(), &ssh.ClientConfig{
+		User:            "slex",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newSFTPClient returns an sftp client connected to a server of the tests.
+func newSFTPClient(t *testing.T) *sftp.Client {
+	c, err := sftp.NewClient(newTestClient(t, sshtest.Config{SFTP: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSFTPUploaderExclusive(t *testing.T) {
+	c := newSFTPClient(t)
+	p := filepath.Join(t.TempDir(), "script")
+	if err := ioutil.WriteFile(p, []byte("existing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u := &sftpUploader{client: c, exclusive: true}
+	if err := u.upload(strings.NewReader("replaced\n"), 9, 0600, p); err == nil {
+		t.Error("expected the exclusive upload to fail on an existing file")
+	}
+	if content := mustRead(t, p); content != "existing\n" {
+		t.Errorf("expected the existing file to be kept, got %q", content)
+	}
+
+	u.exclusive = false
+	if err := u.upload(strings.NewReader("replaced\n"), 9, 0600, p); err != nil {
+		t.Fatal(err)
+	}
+	if content := mustRead(t, p); content != "replaced\n" {
+		t.Errorf("expected the file to be replaced, got %q", content)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+// recorder records the output of each host of a run in a directory as an
+// asciicast v2 file, replayable with asciinema, along with the manifest of the run.
+// Each run is recorded in its own directory so that earlier recordings are kept.
+type recorder struct {
+	// base is the directory of the --record flag containing the runs
+	base string
+	// dir is the directory of the current run, empty until the run begins
+	dir string
+	// command is the command run on the hosts, the command line of slex when empty
+	command  string
+	operator string
+	// files are the names of the asciicast files of the hosts by index
+	files         []string
+	width, height int
+
+	mu sync.Mutex
+	// attempts are the number of times each host was started in the current run
+	attempts []int
+}
+
+// unsafeFileChars are replaced in the names of the asciicast files.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// newRecorder returns the recorder of the --record flag or nil when it's not set.
+func newRecorder(context *cli.Context, hosts []string) (*recorder, error) {
+	dir := context.GlobalString("record")
+	if dir == "" {
+		return nil, nil
+	}
+	if context.GlobalBool("quiet") {
+		return nil, fmt.Errorf("the output is recorded by --record, it can't be disabled with --quiet")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	operator := "unknown"
+	if u, err := user.Current(); err == nil {
+		operator = u.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		operator += "@" + hostname
+	}
+	r := &recorder{
+		base:     dir,
+		operator: operator,
+	}
+	r.width, r.height = terminalSize()
+	seen := make(map[string]bool)
+	for i, host := range hosts {
+		name := unsafeFileChars.ReplaceAllString(host, "_")
+		if seen[name] {
+			name = fmt.Sprintf("%s-%d", name, i)
+		}
+		seen[name] = true
+		r.files = append(r.files, name+".cast")
+	}
+	return r, nil
+}
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// begin creates the directory of a new run, named after the time it started.
+func (r *recorder) begin(started time.Time) error {
+	name := started.Format("20060102-150405")
+	for i := 1; ; i++ {
+		dir := filepath.Join(r.base, name)
+		if i > 1 {
+			dir = fmt.Sprintf("%s-%d", dir, i)
+		}
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			r.mu.Lock()
+			r.dir, r.attempts = dir, make([]int, len(r.files))
+			r.mu.Unlock()
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+	}
+}
+
+// castFile returns the name of the asciicast file of the attempt of the host
+// at the index, the retries of the host are recorded in their own files.
+func (r *recorder) castFile(index, attempt int) string {
+	if attempt <= 1 {
+		return r.files[index]
+	}
+	return fmt.Sprintf("%s.%d.cast", strings.TrimSuffix(r.files[index], ".cast"), attempt)
+}
+
+// open creates the asciicast file of the next attempt of the job.
+func (r *recorder) open(j *job) (*castWriter, error) {
+	r.mu.Lock()
+	r.attempts[j.index]++
+	path := filepath.Join(r.dir, r.castFile(j.index, r.attempts[j.index]))
+	r.mu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &castWriter{
+		f:     f,
+		start: time.Now(),
+	}
+	header, err := json.Marshal(castHeader{
+		Version:   2,
+		Width:     r.width,
+		Height:    r.height,
+		Timestamp: w.start.Unix(),
+		Command:   r.command,
+		Title:     j.name,
+		Env:       map[string]string{"TERM": os.Getenv("TERM")},
+	})
+	if err == nil {
+		_, err = f.Write(append(header, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// runManifest describes a recorded run, it's saved next to the asciicast files.
+type runManifest struct {
+	// Command is the command run on the hosts when there is one
+	Command string `json:"command,omitempty"`
+	// Args is the command line of slex
+	Args     []string        `json:"args"`
+	Operator string          `json:"operator"`
+	Started  time.Time       `json:"started"`
+	Ended    time.Time       `json:"ended"`
+	Hosts    []*manifestHost `json:"hosts"`
+}
+
+type manifestHost struct {
+	Host string `json:"host"`
+	Addr string `json:"addr,omitempty"`
+	User string `json:"user,omitempty"`
+	// Cast is the asciicast file of the output of the host, relative to the manifest
+	Cast    string     `json:"cast,omitempty"`
+	Started *time.Time `json:"started,omitempty"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	// ExitCode is the exit status of the command, null when it did not exit
+	ExitCode *int `json:"exit_code"`
+	// Error is why the host failed when it's not the exit status, i.e. an
+	// unmet expectation or a connection failure
+	Error string `json:"error,omitempty"`
+}
+
+// finish writes the manifest of the run that started at started.
+func (r *recorder) finish(jobs []*job, started time.Time) error {
+	manifest := &runManifest{
+		Command:  r.command,
+		Args:     os.Args,
+		Operator: r.operator,
+		Started:  started,
+		Ended:    time.Now(),
+	}
+	for _, j := range jobs {
+		j.mu.Lock()
+		h := &manifestHost{
+			Host: j.name,
+		}
+		if !j.started.IsZero() {
+			started, ended := j.started, j.ended
+			h.Addr, h.User, h.Started, h.Ended = j.host, j.user, &started, &ended
+			r.mu.Lock()
+			h.Cast = r.castFile(j.index, r.attempts[j.index])
+			r.mu.Unlock()
+		}
+		h.ExitCode = j.exitStatus
+		var exitErr *ssh.ExitError
+		if j.err != nil && !errors.As(j.err, &exitErr) {
+			h.Error = j.err.Error()
+		}
+		j.mu.Unlock()
+		manifest.Hosts = append(manifest.Hosts, h)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.dir, "manifest.json"), append(data, '\n'), 0600)
+}
+
+// castWriter writes the output written to it as the output events of an
+// asciicast file with the time elapsed since the start of the recording.
+type castWriter struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+	// pending is the incomplete UTF-8 sequence at the end of the last write
+	pending []byte
+	// cr is true when the last byte written was a carriage return
+	cr  bool
+	err error
+}
+
+func (w *castWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := append(w.pending, p...)
+	w.pending = nil
+	// a character split across writes is written with the following write
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				w.pending = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			break
+		}
+	}
+	if len(data) == 0 {
+		return len(p), nil
+	}
+	w.event(w.translate(data))
+	return len(p), w.err
+}
+
+// translate returns the output with new lines as a terminal displays them,
+// the output of a command without a pseudo terminal has no carriage returns.
+func (w *castWriter) translate(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == '\n' && !w.cr {
+			out = append(out, '\r')
+		}
+		out = append(out, b)
+		w.cr = b == '\r'
+	}
+	return out
+}
+
+// event writes the output event of the data, invalid UTF-8 is replaced.
+func (w *castWriter) event(data []byte) {
+	elapsed := math.Round(time.Since(w.start).Seconds()*1e6) / 1e6
+	line, err := json.Marshal([]interface{}{elapsed, "o", string(data)})
+	if err == nil {
+		_, err = w.f.Write(append(line, '\n'))
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+// Close writes the incomplete character left and closes the file.
+func (w *castWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) > 0 {
+		w.event(w.pending)
+		w.pending = nil
+	}
+	if err := w.f.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
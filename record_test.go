@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCastWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r := &recorder{base: dir, files: []string{"web1.cast"}, width: 80, height: 24}
+	if err := r.begin(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.open(&job{name: "web1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the é is split across the writes, the pseudo terminal output has carriage returns
+	for _, s := range []string{"caf\xc3", "\xa9\nline\r", "\n", "done\r\n"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a retry of the host is recorded in its own file
+	retry, err := r.open(&job{name: "web1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry.Close()
+	if _, err := os.Stat(filepath.Join(r.dir, "web1.2.cast")); err != nil {
+		t.Errorf("expected the retry to be recorded in web1.2.cast - %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, "web1.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var header castHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 || header.Title != "web1" {
+		t.Errorf("unexpected header %s", lines[0])
+	}
+	var (
+		output string
+		last   float64
+	)
+	for _, l := range lines[1:] {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(l), &event); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := event[0].(float64); elapsed < last || event[1] != "o" {
+			t.Errorf("unexpected event %s", l)
+		} else {
+			last = elapsed
+		}
+		output += event[2].(string)
+	}
+	if expected := "café\r\nline\r\ndone\r\n"; output != expected {
+		t.Errorf("expected the output %q, got %q", expected, output)
+	}
+}
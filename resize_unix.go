@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// watchWindowSize forwards the size of the local terminal to the session
+// each time it changes until the returned function is called.
+func watchWindowSize(fd int, session *runner.Session) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	stop := forwardWindowSize(sigs, func() (int, int, error) {
+		return terminal.GetSize(fd)
+	}, session)
+	return func() {
+		signal.Stop(sigs)
+		stop()
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "github.com/crosbymichael/slex/pkg/runner"
+
+// watchWindowSize is not supported on windows as there is no signal for
+// terminal size changes.
+func watchWindowSize(fd int, session *runner.Session) func() {
+	return func() {}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var runCommand = cli.Command{
+	Name:      "run",
+	Usage:     "execute the steps of a runbook on all hosts",
+	ArgsUsage: "RUNBOOK",
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "var",
+			Usage: "set a runbook variable, overriding the value from the runbook, i.e. name=value",
+			Value: &cli.StringSlice{},
+		},
+	},
+	Action: runAction,
+}
+
+// runAction executes the runbook on all hosts and prints the result of each step.
+func runAction(context *cli.Context) error {
+	if context.NArg() != 1 {
+		return fmt.Errorf("RUNBOOK must be specified")
+	}
+	rb, err := loadRunbook(context.Args().First())
+	if err != nil {
+		return err
+	}
+	for _, v := range context.StringSlice("var") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid var format %s", v)
+		}
+		rb.Vars[parts[0]] = parts[1]
+	}
+	env, err := parseEnvironment(context)
+	if err != nil {
+		return err
+	}
+	become, err := newBecome(context)
+	if err != nil {
+		return err
+	}
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if m.expect, err = newExpectations(context); err != nil {
+		return err
+	}
+
+	c := command{
+		User:   m.user,
+		Env:    env,
+		Become: become,
+	}
+	quiet := context.GlobalBool("quiet")
+	log.Debugf("running runbook %s", rb.Name)
+	jobs, err := m.run(func(ctx gocontext.Context, j *job, session *runner.Session) error {
+		return rb.run(ctx, j, session, c, quiet)
+	})
+	if err != nil {
+		return err
+	}
+	printRunbookSummary(os.Stdout, jobs)
+	if m.expect != nil {
+		if failed := printAssertions(os.Stdout, jobs); failed > 0 {
+			return fmt.Errorf("%d of %d hosts failed", failed, len(jobs))
+		}
+	}
+	return nil
+}
+
+// runbook is a sequence of steps executed in order on each host.
+type runbook struct {
+	Name string `yaml:"name"`
+	// Vars are available to the templates of the steps
+	Vars  map[string]string `yaml:"vars"`
+	Steps []*runbookStep    `yaml:"steps"`
+	// OnFailure are the steps executed when a step fails on a host,
+	// after the handlers of the failed step
+	OnFailure []*runbookStep `yaml:"on_failure"`
+}
+
+// runbookStep either executes a command or uploads a file. Commands, paths and
+// conditions are templates executed with the vars, the registered results and .Host.
+type runbookStep struct {
+	Name string      `yaml:"name"`
+	Run  string      `yaml:"run"`
+	Put  *runbookPut `yaml:"put"`
+	// When skips the step unless the condition is true
+	When string `yaml:"when"`
+	// Register stores the result of the step under the name
+	Register string `yaml:"register"`
+	// Retries is the number of times the step is executed again when it fails
+	// or its Until condition is false
+	Retries int           `yaml:"retries"`
+	Delay   time.Duration `yaml:"delay"`
+	Until   string        `yaml:"until"`
+	// IgnoreErrors continues with the next step when the step fails
+	IgnoreErrors bool           `yaml:"ignore_errors"`
+	OnFailure    []*runbookStep `yaml:"on_failure"`
+}
+
+type runbookPut struct {
+	Src   string `yaml:"src"`
+	Dest  string `yaml:"dest"`
+	Owner string `yaml:"owner"`
+}
+
+// stepOutput is the result of a step available to the templates of the
+// following steps under the name it's registered as.
+type stepOutput struct {
+	Stdout   string
+	ExitCode int
+	Failed   bool
+	Skipped  bool
+}
+
+const (
+	defaultRetries = 3
+	defaultDelay   = 5 * time.Second
+)
+
+// loadRunbook reads and validates the runbook file.
+func loadRunbook(path string) (*runbook, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRunbook(data)
+}
+
+func parseRunbook(data []byte) (*runbook, error) {
+	var rb runbook
+	if err := yaml.UnmarshalStrict(data, &rb); err != nil {
+		return nil, err
+	}
+	if len(rb.Steps) == 0 {
+		return nil, fmt.Errorf("runbook has no steps")
+	}
+	if rb.Vars == nil {
+		rb.Vars = make(map[string]string)
+	}
+	names := map[string]bool{"Host": true}
+	for name := range rb.Vars {
+		names[name] = true
+	}
+	for i, s := range rb.Steps {
+		if err := s.validate(fmt.Sprintf("step %d", i+1), names, true); err != nil {
+			return nil, err
+		}
+	}
+	for i, s := range rb.OnFailure {
+		if err := s.validate(fmt.Sprintf("handler %d", i+1), names, false); err != nil {
+			return nil, err
+		}
+	}
+	return &rb, nil
+}
+
+// validate checks the step and sets its defaults. names holds the vars and
+// the names registered by the previous steps.
+func (s *runbookStep) validate(name string, names map[string]bool, handlers bool) error {
+	if s.Name == "" {
+		s.Name = name
+	}
+	if (s.Run == "") == (s.Put == nil) {
+		return fmt.Errorf("%s: exactly one of run or put must be set", s.Name)
+	}
+	if s.Put != nil && (s.Put.Src == "" || s.Put.Dest == "") {
+		return fmt.Errorf("%s: put requires src and dest", s.Name)
+	}
+	if s.Register != "" {
+		if names[s.Register] {
+			return fmt.Errorf("%s: %s is already registered or a var", s.Name, s.Register)
+		}
+		names[s.Register] = true
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("%s: retries cannot be negative", s.Name)
+	}
+	if s.Until != "" && s.Retries == 0 {
+		s.Retries = defaultRetries
+	}
+	if s.Retries > 0 && s.Delay == 0 {
+		s.Delay = defaultDelay
+	}
+	for _, text := range []string{s.Run, s.When, s.Until} {
+		if _, err := newStepTemplate(text); err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+	}
+	if !handlers && len(s.OnFailure) > 0 {
+		return fmt.Errorf("%s: handlers cannot have on_failure", s.Name)
+	}
+	for i, h := range s.OnFailure {
+		if err := h.validate(fmt.Sprintf("%s handler %d", s.Name, i+1), names, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var stepFuncs = template.FuncMap{
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+	"trim":      strings.TrimSpace,
+	"split":     strings.Split,
+	"atoi": func(s string) (int, error) {
+		return strconv.Atoi(strings.TrimSpace(s))
+	},
+}
+
+func newStepTemplate(text string) (*template.Template, error) {
+	return template.New("step").Funcs(stepFuncs).Option("missingkey=error").Parse(text)
+}
+
+// render executes the template text with the data.
+func render(text string, data map[string]interface{}) (string, error) {
+	t, err := newStepTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// evalCondition returns the value of the condition, an expression of the
+// template language such as `eq .check.ExitCode 0`.
+func evalCondition(cond string, data map[string]interface{}) (bool, error) {
+	v, err := render("{{ "+cond+" }}", data)
+	if err != nil {
+		return false, err
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return false, fmt.Errorf("condition %q is not a boolean: %q", cond, v)
+	}
+	return b, nil
+}
+
+// run executes the steps on the host. When a step fails its handlers and
+// the handlers of the runbook are executed before the error is returned.
+func (rb *runbook) run(ctx gocontext.Context, j *job, session *runner.Session, c command, quiet bool) error {
+	r := &runbookRun{
+		ctx:     ctx,
+		job:     j,
+		session: session,
+		c:       c,
+		quiet:   quiet,
+		data:    map[string]interface{}{"Host": j.name},
+	}
+	for k, v := range rb.Vars {
+		r.data[k] = v
+	}
+	for _, s := range rb.Steps {
+		if err := r.step(s); err != nil {
+			r.handle(s.OnFailure)
+			r.handle(rb.OnFailure)
+			return &stepError{name: s.Name, err: err}
+		}
+	}
+	return nil
+}
+
+// runbookRun is the state of a runbook executed on a host.
+type runbookRun struct {
+	// ctx is done once the job is canceled
+	ctx     gocontext.Context
+	job     *job
+	session *runner.Session
+	c       command
+	quiet   bool
+	data    map[string]interface{}
+}
+
+// handle executes the handlers, a failing handler does not stop the others.
+func (r *runbookRun) handle(handlers []*runbookStep) {
+	for _, h := range handlers {
+		if err := r.step(h); err != nil {
+			log.Debugf("handler %s failed on %s - %v", h.Name, r.job.name, err)
+		}
+	}
+}
+
+// step executes the step until it succeeds and its until condition is true or
+// the retries are exhausted. The error is nil when the errors are ignored.
+func (r *runbookRun) step(s *runbookStep) error {
+	if s.When != "" {
+		ok, err := evalCondition(s.When, r.data)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			r.record(s, stepOutput{Skipped: true}, stepResult{name: s.Name, skipped: true})
+			return nil
+		}
+	}
+
+	var (
+		out   stepOutput
+		err   error
+		start = time.Now()
+	)
+	for attempt := 1; attempt <= s.Retries+1; attempt++ {
+		if attempt > 1 {
+			r.job.setProgress("%s (attempt %d/%d)", s.Name, attempt, s.Retries+1)
+			if err := r.wait(s.Delay); err != nil {
+				r.record(s, out, stepResult{name: s.Name, err: err, duration: time.Since(start)})
+				return err
+			}
+		} else {
+			r.job.setProgress("%s", s.Name)
+		}
+		out, err = r.execute(s)
+		if s.Register != "" {
+			r.data[s.Register] = out
+		}
+		if s.Until == "" {
+			if err == nil {
+				break
+			}
+			continue
+		}
+		ok, cerr := evalCondition(s.Until, r.data)
+		if cerr != nil {
+			err = cerr
+			break
+		}
+		if ok {
+			err = nil
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("until condition not met after %d attempts", attempt)
+		}
+	}
+	if s.IgnoreErrors {
+		if err != nil {
+			log.Debugf("ignoring error of %s on %s - %v", s.Name, r.job.name, err)
+		}
+		r.record(s, out, stepResult{name: s.Name, err: err, ignored: true, duration: time.Since(start)})
+		return nil
+	}
+	r.record(s, out, stepResult{name: s.Name, err: err, duration: time.Since(start)})
+	return err
+}
+
+// wait waits for the delay between the attempts of a step, it returns the
+// error of the context when the job is canceled first.
+func (r *runbookRun) wait(delay time.Duration) error {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (r *runbookRun) record(s *runbookStep, out stepOutput, res stepResult) {
+	if s.Register != "" {
+		r.data[s.Register] = out
+	}
+	r.job.addStep(res)
+}
+
+// execute runs the command or the upload of the step once.
+func (r *runbookRun) execute(s *runbookStep) (stepOutput, error) {
+	var (
+		out stepOutput
+		err error
+	)
+	if s.Put != nil {
+		err = r.put(s.Put)
+	} else {
+		err = r.runCmd(s.Run, &out)
+	}
+	switch e := err.(type) {
+	case nil:
+	case *ssh.ExitError:
+		out.ExitCode = e.ExitStatus()
+		out.Failed = true
+	default:
+		out.ExitCode = -1
+		out.Failed = true
+	}
+	return out, err
+}
+
+func (r *runbookRun) runCmd(text string, out *stepOutput) error {
+	cmd, err := render(text, r.data)
+	if err != nil {
+		return err
+	}
+	session, err := r.session.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Session.Close()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	c := r.c
+	c.Cmd = cmd
+	err = runSSH(r.job, session, c, r.quiet)
+	out.Stdout = stdout.String()
+	return err
+}
+
+func (r *runbookRun) put(put *runbookPut) error {
+	var (
+		p   = &putter{owner: put.Owner}
+		err error
+	)
+	if p.local, err = render(put.Src, r.data); err != nil {
+		return err
+	}
+	if p.remote, err = render(put.Dest, r.data); err != nil {
+		return err
+	}
+	u, err := newUploader(r.session.Client, false)
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+	return p.put(r.job, u, r.session.Client)
+}
+
+// printRunbookSummary writes the result and duration of the steps executed on each host.
+func printRunbookSummary(w io.Writer, jobs []*job) {
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTEP\tSTATUS\tTIME")
+	for _, j := range jobs {
+		if len(j.steps) == 0 && j.err != nil {
+			fmt.Fprintf(tw, "%s\t-\tERROR %s\t-\n", j.name, j.err)
+		}
+		for _, s := range j.steps {
+			status := "OK"
+			switch {
+			case s.skipped:
+				status = "SKIPPED"
+			case s.err != nil && s.ignored:
+				status = fmt.Sprintf("IGNORED %s", s.err)
+			case s.err != nil:
+				status = fmt.Sprintf("ERROR %s", s.err)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", j.name, s.name, status, s.duration.Round(time.Millisecond))
+		}
+	}
+	tw.Flush()
+}
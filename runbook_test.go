@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshtest"
+)
+
+func TestParseRunbook(t *testing.T) {
+	rb, err := parseRunbook([]byte(`
+vars:
+  port: 8080
+steps:
+  - run: curl localhost:{{.port}}
+    register: health
+    until: eq .health.ExitCode 0
+  - name: upload
+    put: {src: a, dest: b}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.Vars["port"] != "8080" {
+		t.Errorf("expected the port var to be 8080 but received %q", rb.Vars["port"])
+	}
+	s := rb.Steps[0]
+	if s.Name != "step 1" || s.Retries != defaultRetries || s.Delay != defaultDelay {
+		t.Errorf("defaults are not set: %q %d %s", s.Name, s.Retries, s.Delay)
+	}
+
+	for _, invalid := range []string{
+		`steps: [{name: a}]`,
+		`steps: [{run: a, put: {src: a, dest: b}}]`,
+		`steps: [{run: a, register: Host}]`,
+		`steps: [{run: a, register: x}, {run: b, register: x}]`,
+		`steps: [{run: a, when: "{{"}]`,
+		`steps: [{run: a, unknown: true}]`,
+		`{steps: [{run: a}], on_failure: [{run: a, on_failure: [{run: b}]}]}`,
+	} {
+		if _, err := parseRunbook([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	data := map[string]interface{}{
+		"Host": "a",
+		"disk": stepOutput{Stdout: "91\n", ExitCode: 0},
+	}
+	for cond, expected := range map[string]bool{
+		`eq .disk.ExitCode 0`:             true,
+		`gt (atoi .disk.Stdout) 90`:       true,
+		`contains .disk.Stdout "80"`:      false,
+		`and .disk.Failed (eq .Host "a")`: false,
+	} {
+		v, err := evalCondition(cond, data)
+		if err != nil {
+			t.Errorf("%s: %v", cond, err)
+			continue
+		}
+		if v != expected {
+			t.Errorf("%s: expected %t but received %t", cond, expected, v)
+		}
+	}
+	if _, err := evalCondition(`.missing`, data); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+	if _, err := evalCondition(`.disk.Stdout`, data); err == nil {
+		t.Error("expected an error for a condition that is not a boolean")
+	}
+}
+
+// runbookHandler counts the executions of the count command and prints their number,
+// exits with the status of exit N, prints sudo to stdout and stderr and echoes the
+// other commands.
+func runbookHandler(mu *sync.Mutex, commands *[]string) sshtest.Handler {
+	count := 0
+	return func(e *sshtest.Exec) int {
+		mu.Lock()
+		defer mu.Unlock()
+		*commands = append(*commands, e.Command)
+		var status int
+		switch {
+		case e.Command == "count":
+			count++
+			fmt.Fprintf(e.Stdout, "%d\n", count)
+		case strings.HasPrefix(e.Command, "sudo "):
+			fmt.Fprint(e.Stdout, "stdout")
+			fmt.Fprint(e.Stderr, "stderr")
+		case strings.HasPrefix(e.Command, "exit "):
+			fmt.Sscanf(e.Command, "exit %d", &status)
+		default:
+			fmt.Fprint(e.Stdout, e.Command)
+		}
+		return status
+	}
+}
+
+func TestRunbookRun(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		runbook string
+		become  *become
+		// err is a part of the expected error, the run succeeds when it's empty
+		err      string
+		commands []string
+		// summary are the name and the status of each step
+		summary []string
+	}{
+		{
+			name: "retries until",
+			runbook: `
+steps:
+  - name: wait
+    run: count
+    register: counter
+    until: eq (trim .counter.Stdout) "3"
+    retries: 5
+    delay: 1ms
+  - name: report
+    run: got {{trim .counter.Stdout}} {{.counter.ExitCode}}
+`,
+			commands: []string{"count", "count", "count", "got 3 0"},
+			summary:  []string{"wait OK", "report OK"},
+		},
+		{
+			name: "until not met",
+			runbook: `
+steps:
+  - name: wait
+    run: count
+    register: counter
+    until: eq (trim .counter.Stdout) "9"
+    retries: 1
+    delay: 1ms
+`,
+			err:      "until condition not met after 2 attempts",
+			commands: []string{"count", "count"},
+			summary:  []string{"wait ERROR until condition not met after 2 attempts"},
+		},
+		{
+			name: "ignore errors",
+			runbook: `
+steps:
+  - name: check
+    run: exit 3
+    register: check
+    ignore_errors: true
+  - name: report
+    run: code {{.check.ExitCode}} {{.check.Failed}}
+  - name: skipped
+    run: never
+    when: not .check.Failed
+`,
+			commands: []string{"exit 3", "code 3 true"},
+			summary:  []string{"check IGNORED Process exited with status 3", "report OK", "skipped SKIPPED"},
+		},
+		{
+			name: "on failure",
+			runbook: `
+steps:
+  - name: deploy
+    run: exit 2
+    on_failure:
+      - run: rollback
+  - name: never
+    run: never
+on_failure:
+  - run: notify {{.Host}}
+`,
+			err:      "deploy: Process exited with status 2",
+			commands: []string{"exit 2", "rollback", "notify web1"},
+			summary:  []string{"deploy ERROR Process exited with status 2", "deploy handler 1 OK", "handler 1 OK"},
+		},
+		{
+			name: "become registers stdout",
+			runbook: `
+steps:
+  - name: whoami
+    run: id
+    register: id
+  - name: report
+    run: got {{.id.Stdout}}
+`,
+			become:   &become{},
+			commands: []string{"sudo -n -- sh -c 'id'", "sudo -n -- sh -c 'got stdout'"},
+			summary:  []string{"whoami OK", "report OK"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rb, err := parseRunbook([]byte(tc.runbook))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				mu       sync.Mutex
+				commands []string
+			)
+			session := newTestSession(t, runbookHandler(&mu, &commands))
+			j := newTestJob(t, "web1")
+
+			err = rb.run(gocontext.Background(), j, session, command{Become: tc.become}, false)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expected an error with %q, got %v", tc.err, err)
+			}
+			mu.Lock()
+			if strings.Join(commands, "\n") != strings.Join(tc.commands, "\n") {
+				t.Errorf("expected the commands %q, got %q", tc.commands, commands)
+			}
+			mu.Unlock()
+
+			var out bytes.Buffer
+			printRunbookSummary(&out, []*job{j})
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")[1:]
+			if len(lines) != len(tc.summary) {
+				t.Fatalf("expected %d steps in the summary, got:\n%s", len(tc.summary), out.String())
+			}
+			for i, expected := range tc.summary {
+				if got := strings.Join(strings.Fields(lines[i])[1:], " "); !strings.HasPrefix(got, expected) {
+					t.Errorf("expected the step %q, got %q", expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunbookRetryCanceled(t *testing.T) {
+	rb, err := parseRunbook([]byte(`
+steps:
+  - run: exit 1
+    retries: 1
+    delay: 1h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		commands []string
+	)
+	session := newTestSession(t, runbookHandler(&mu, &commands))
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- rb.run(ctx, newTestJob(t, "web1"), session, command{}, true)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), gocontext.Canceled.Error()) {
+			t.Errorf("expected the run to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the delay between the attempts to be interrupted")
+	}
+}
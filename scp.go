@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scpUploader uploads files with the scp protocol for hosts
+// that do not provide the sftp subsystem.
+type scpUploader struct {
+	client *ssh.Client
+}
+
+func (u *scpUploader) isDir(p string) (bool, error) {
+	session, err := u.client.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	err = session.Run("test -d " + shellQuote(p))
+	if exit, ok := err.(*ssh.ExitError); ok && exit.ExitStatus() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (u *scpUploader) mkdir(p string, mode os.FileMode) error {
+	return runRemote(u.client, fmt.Sprintf("mkdir -p %s && chmod %04o %s", shellQuote(p), unixMode(mode), shellQuote(p)))
+}
+
+// upload sends the content of r with the scp sink protocol, the remote
+// scp writes it to p as p is not an existing directory.
+func (u *scpUploader) upload(r io.Reader, size int64, mode os.FileMode, p string) error {
+	session, err := u.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start("scp -qt " + shellQuote(p)); err != nil {
+		return err
+	}
+	acks := bufio.NewReader(stdout)
+
+	send := func() error {
+		if err := scpAck(acks); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(stdin, "C%04o %d %s\n", unixMode(mode), size, path.Base(p)); err != nil {
+			return err
+		}
+		if err := scpAck(acks); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(stdin, r, size); err != nil {
+			return err
+		}
+		if _, err := stdin.Write([]byte{0}); err != nil {
+			return err
+		}
+		return scpAck(acks)
+	}
+	if err := send(); err != nil {
+		stdin.Close()
+		session.Wait()
+		return err
+	}
+	stdin.Close()
+	return session.Wait()
+}
+
+func (u *scpUploader) chmod(p string, mode os.FileMode) error {
+	return runRemote(u.client, fmt.Sprintf("chmod %04o %s", unixMode(mode), shellQuote(p)))
+}
+
+func (u *scpUploader) rename(from, to string) error {
+	return runRemote(u.client, fmt.Sprintf("mv -f %s %s", shellQuote(from), shellQuote(to)))
+}
+
+func (u *scpUploader) remove(p string) error {
+	return runRemote(u.client, "rm -f "+shellQuote(p))
+}
+
+func (u *scpUploader) Close() error {
+	return nil
+}
+
+// scpAck reads the response of the remote scp to the last message.
+func scpAck(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+	msg, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if msg = strings.TrimSuffix(msg, "\n"); msg == "" {
+		return errors.New("scp: unknown error")
+	}
+	return fmt.Errorf("scp: %s", msg)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+var scriptCommand = cli.Command{
+	Name:      "script",
+	Usage:     "upload a local script and execute it on all hosts",
+	ArgsUsage: "SCRIPT [ARGS...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "interpreter",
+			Usage: "interpreter to execute the script with instead of the one from its shebang line",
+		},
+		cli.StringFlag{
+			Name:  "remote-dir",
+			Usage: "directory the script is uploaded to on the hosts",
+			Value: "/tmp",
+		},
+		cli.BoolFlag{
+			Name:  "scp",
+			Usage: "upload with the scp protocol instead of sftp",
+		},
+	},
+	Action: scriptAction,
+}
+
+// scriptAction uploads the script to a temporary path on all hosts,
+// executes it with the arguments and removes it afterwards.
+func scriptAction(context *cli.Context) error {
+	if context.NArg() == 0 {
+		return fmt.Errorf("no script specified")
+	}
+	script := context.Args().First()
+	info, err := os.Stat(script)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", script)
+	}
+
+	interpreter := context.String("interpreter")
+	if interpreter == "" {
+		if interpreter, err = readShebang(script); err != nil {
+			return err
+		}
+	}
+	env, err := parseEnvironment(context)
+	if err != nil {
+		return err
+	}
+	become, err := newBecome(context)
+	if err != nil {
+		return err
+	}
+
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			// a second interrupt terminates slex without cleaning up
+			signal.Stop(signals)
+			close(interrupted)
+		}
+	}()
+
+	var (
+		quiet    = context.GlobalBool("quiet")
+		forceSCP = context.Bool("scp")
+		args     = context.Args().Tail()
+		dir      = context.String("remote-dir")
+	)
+	if _, err := m.run(func(_ gocontext.Context, j *job, session *runner.Session) error {
+		select {
+		case <-interrupted:
+			return errInterrupted
+		default:
+		}
+
+		u, err := newUploader(session.Client, forceSCP)
+		if err != nil {
+			return err
+		}
+		defer u.Close()
+		if su, ok := u.(*sftpUploader); ok {
+			// the temporary path must not be an existing file of the host
+			su.exclusive = true
+		}
+
+		remote := tempName(path.Join(dir, filepath.Base(script)))
+		f, err := os.Open(script)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// The script is removed even when the upload fails part way through.
+		defer func() {
+			if err := runRemote(session.Client, "rm -f "+shellQuote(remote)); err != nil {
+				log.Debugf("failed to remove %s from %s - %v", remote, j.host, err)
+			}
+		}()
+		if err := u.upload(newProgressReader(f, j, path.Base(script), info.Size()), info.Size(), 0700, remote); err != nil {
+			return err
+		}
+		if err := u.chmod(remote, 0700); err != nil {
+			return err
+		}
+		j.mu.Lock()
+		j.progress = ""
+		j.mu.Unlock()
+
+		c := command{
+			Cmd:    scriptCmd(interpreter, remote, args),
+			User:   m.user,
+			Env:    env,
+			Become: become,
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- runSSH(j, session, c, quiet)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-interrupted:
+			if err := session.Signal(ssh.SIGTERM); err != nil {
+				log.Debugf("failed to signal the script on %s - %v", j.host, err)
+			}
+			session.Session.Close()
+			return errInterrupted
+		}
+	}); err != nil {
+		return err
+	}
+
+	log.Debugf("finished executing %s on all hosts", script)
+	return nil
+}
+
+// readShebang returns the interpreter from the first line of the script,
+// defaulting to sh when the script has no shebang line.
+func readShebang(script string) (string, error) {
+	f, err := os.Open(script)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return "sh", nil
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return "sh", nil
+	}
+	interpreter := strings.TrimSpace(line[2:])
+	if interpreter == "" {
+		return "sh", nil
+	}
+	return interpreter, nil
+}
+
+// scriptCmd returns the command executing the remote script with the interpreter,
+// each of the arguments is quoted to reach the script unchanged.
+func scriptCmd(interpreter, remote string, args []string) string {
+	parts := []string{interpreter, shellQuote(remote)}
+	for _, a := range args {
+		parts = append(parts, shellQuote(a))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	gocontext "context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+)
+
+const shellHelp = `Lines are executed on every enabled host of the current group.
+Built-in commands:
+  :hosts                   list the hosts with their state and last exit code
+  :add HOST...             add hosts to the shell
+  :remove HOST...          close the connections and remove the hosts
+  :on HOST...              enable the hosts
+  :off HOST...             disable the hosts, they are kept connected
+  :group NAME HOST...      define a group of hosts
+  :use NAME|HOST,...|all   execute the following lines on a list of groups and hosts
+  :status                  show the exit code of the last command on each host
+  :help                    show this help
+  :quit                    close all connections and exit
+`
+
+var shellCommand = cli.Command{
+	Name:  "shell",
+	Usage: "execute each line typed at the prompt on all hosts over persistent connections",
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "keepalive",
+			Usage: "interval of the keepalive requests sent on idle connections",
+			Value: 30 * time.Second,
+		},
+	},
+	Action: shellAction,
+}
+
+// shellAction starts a prompt executing each line on all hosts.
+func shellAction(context *cli.Context) error {
+	env, err := parseEnvironment(context)
+	if err != nil {
+		return err
+	}
+	become, err := newBecome(context)
+	if err != nil {
+		return err
+	}
+	// the hosts can be added with :add once the shell started
+	m, err := loadMultiplexer(context, false)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if m.tui {
+		return fmt.Errorf("the shell reads the commands from the terminal, it can't run in the terminal UI")
+	}
+	if m.record != nil {
+		return fmt.Errorf("the output of the shell can't be recorded with --record")
+	}
+
+	sh := newShell(m, env, become, context.GlobalBool("quiet"), context.Duration("keepalive"))
+	defer sh.Close()
+	return sh.loop(os.Stdin, os.Stdout)
+}
+
+// shellHost is a host of the shell with its persistent connection.
+type shellHost struct {
+	name    string
+	enabled bool
+	// status is the exit code or the error of the last command
+	status string
+
+	mu      sync.Mutex
+	client  *ssh.Client
+	options sshconfig.ClientOptions
+	done    chan struct{}
+}
+
+// shell executes lines on the hosts over one connection per host kept open between lines.
+type shell struct {
+	m         *multiplexer
+	env       map[string]string
+	become    *become
+	quiet     bool
+	keepalive time.Duration
+
+	hosts  map[string]*shellHost
+	order  []string
+	groups map[string][]string
+	// use is the list of hosts the lines are executed on, all hosts when empty
+	use []string
+}
+
+func newShell(m *multiplexer, env map[string]string, become *become, quiet bool, keepalive time.Duration) *shell {
+	sh := &shell{
+		m:         m,
+		env:       env,
+		become:    become,
+		quiet:     quiet,
+		keepalive: keepalive,
+		hosts:     make(map[string]*shellHost),
+		groups:    make(map[string][]string),
+	}
+	sh.add(m.hosts)
+	return sh
+}
+
+// loop reads lines from r until EOF or :quit.
+func (sh *shell) loop(r io.Reader, w io.Writer) error {
+	s := bufio.NewScanner(r)
+	fmt.Fprint(w, sh.prompt())
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, ":"):
+			quit, err := sh.builtin(w, strings.Fields(line[1:]))
+			if err != nil {
+				fmt.Fprintf(w, "%s\n", err)
+			}
+			if quit {
+				return nil
+			}
+		default:
+			sh.execute(line)
+		}
+		fmt.Fprint(w, sh.prompt())
+	}
+	fmt.Fprintln(w)
+	return s.Err()
+}
+
+func (sh *shell) prompt() string {
+	if len(sh.use) == 0 {
+		return "slex> "
+	}
+	return fmt.Sprintf("slex [%s]> ", strings.Join(sh.use, ","))
+}
+
+// builtin executes a built-in command, it returns true when the shell should exit.
+func (sh *shell) builtin(w io.Writer, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, fmt.Errorf("no built-in command specified, see :help")
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "quit", "exit":
+		return true, nil
+	case "help":
+		fmt.Fprint(w, shellHelp)
+	case "hosts", "status":
+		for _, name := range sh.order {
+			h := sh.hosts[name]
+			state := "on"
+			if !h.enabled {
+				state = "off"
+			}
+			if cmd == "status" {
+				fmt.Fprintf(w, "%s: %s\n", name, h.status)
+				continue
+			}
+			fmt.Fprintf(w, "%s: %s connected=%t last=%s\n", name, state, h.connected(), h.status)
+		}
+	case "add":
+		sh.add(args)
+	case "remove":
+		for _, name := range args {
+			h, ok := sh.hosts[name]
+			if !ok {
+				return false, fmt.Errorf("unknown host %s", name)
+			}
+			h.close()
+			delete(sh.hosts, name)
+			for i, o := range sh.order {
+				if o == name {
+					sh.order = append(sh.order[:i], sh.order[i+1:]...)
+					break
+				}
+			}
+		}
+	case "on", "off":
+		for _, name := range args {
+			h, ok := sh.hosts[name]
+			if !ok {
+				return false, fmt.Errorf("unknown host %s", name)
+			}
+			h.enabled = cmd == "on"
+		}
+	case "group":
+		if len(args) < 2 {
+			return false, fmt.Errorf("usage: :group NAME HOST...")
+		}
+		sh.groups[args[0]] = args[1:]
+	case "use":
+		if len(args) != 1 {
+			return false, fmt.Errorf("usage: :use NAME|HOST,...|all")
+		}
+		switch {
+		case args[0] == "all":
+			sh.use = nil
+		default:
+			// each name is a group or a host
+			use := strings.Split(args[0], ",")
+			for _, name := range use {
+				_, group := sh.groups[name]
+				_, host := sh.hosts[name]
+				if !group && !host {
+					return false, fmt.Errorf("unknown host or group %s", name)
+				}
+			}
+			sh.use = use
+		}
+	default:
+		return false, fmt.Errorf("unknown built-in command :%s, see :help", cmd)
+	}
+	return false, nil
+}
+
+func (sh *shell) add(names []string) {
+	for _, name := range names {
+		if _, ok := sh.hosts[name]; ok {
+			continue
+		}
+		sh.hosts[name] = &shellHost{
+			name:    name,
+			enabled: true,
+			status:  "-",
+		}
+		sh.order = append(sh.order, name)
+	}
+}
+
+// targets returns the enabled hosts of the current group.
+func (sh *shell) targets() []string {
+	selected := make(map[string]bool)
+	for _, u := range sh.use {
+		if group, ok := sh.groups[u]; ok {
+			for _, name := range group {
+				selected[name] = true
+			}
+			continue
+		}
+		selected[u] = true
+	}
+
+	var hosts []string
+	for _, name := range sh.order {
+		if !sh.hosts[name].enabled {
+			continue
+		}
+		if len(selected) == 0 || selected[name] {
+			hosts = append(hosts, name)
+		}
+	}
+	return hosts
+}
+
+// execute runs the line on the target hosts, connecting to them when needed.
+func (sh *shell) execute(line string) {
+	hosts := sh.targets()
+	if len(hosts) == 0 {
+		log.Warn("no hosts enabled, see :hosts")
+		return
+	}
+	c := command{
+		Cmd:    line,
+		User:   sh.m.user,
+		Env:    sh.env,
+		Become: sh.become,
+	}
+	jobs := sh.m.runHosts(hosts, func(_ gocontext.Context, j *job, h *runner.Host) error {
+		session, err := sh.hosts[j.name].newSession(sh, h)
+		if err != nil {
+			return err
+		}
+		defer session.Session.Close()
+		return runSSH(j, session, c, sh.quiet)
+	}, nil)
+	for _, j := range jobs {
+		sh.hosts[j.name].status = exitStatus(j.err)
+	}
+}
+
+// newSession returns a new session on the persistent connection to the host.
+func (h *shellHost) newSession(sh *shell, host *runner.Host) (*runner.Session, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.client != nil {
+		session, err := h.client.NewSession()
+		if err == nil {
+			return &runner.Session{
+				Client:  h.client,
+				Options: h.options,
+				Session: session,
+			}, nil
+		}
+		log.Debugf("connection to %s lost, reconnecting - %v", h.name, err)
+		h.closeLocked()
+	}
+
+	session, err := sh.m.runner.Connect(gocontext.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	h.client = session.Client
+	h.options = session.Options
+	h.done = make(chan struct{})
+	go h.keepalive(h.client, h.done, sh.keepalive)
+	return session, nil
+}
+
+// keepalive sends keepalive requests on the connection until done is closed.
+func (h *shellHost) keepalive(client *ssh.Client, done chan struct{}, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				log.Debugf("keepalive to %s failed - %v", h.name, err)
+				h.mu.Lock()
+				if h.client == client {
+					h.closeLocked()
+				}
+				h.mu.Unlock()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (h *shellHost) connected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.client != nil
+}
+
+func (h *shellHost) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closeLocked()
+}
+
+func (h *shellHost) closeLocked() {
+	if h.client == nil {
+		return
+	}
+	close(h.done)
+	h.client.Close()
+	h.client = nil
+}
+
+// Close closes the connections to all hosts.
+func (sh *shell) Close() {
+	for _, name := range sh.order {
+		sh.hosts[name].close()
+	}
+}
+
+// exitStatus formats the result of a command as its exit code or error.
+func exitStatus(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return "0"
+	case *ssh.ExitError:
+		return fmt.Sprint(e.ExitStatus())
+	default:
+		return fmt.Sprintf("error: %s", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/crosbymichael/slex/pkg/sshtest"
+)
+
+// newTestShell returns a shell without hosts and the servers it can connect to.
+func newTestShell(t *testing.T, n int) (*shell, []*sshtest.Server) {
+	identity := filepath.Join(t.TempDir(), "id_ecdsa")
+	if _, err := sshtest.WriteKey(identity); err != nil {
+		t.Fatal(err)
+	}
+	servers, err := sshtest.NewServers(n, sshtest.Config{Handler: func(e *sshtest.Exec) int { return 0 }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := runner.New(runner.Options{IdentityFiles: []string{identity}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := newShell(&multiplexer{runner: r}, nil, nil, true, 0)
+	t.Cleanup(func() {
+		sh.Close()
+		r.Close()
+		for _, s := range servers {
+			s.Close()
+		}
+	})
+	return sh, servers
+}
+
+func TestShellBuiltins(t *testing.T) {
+	sh, servers := newTestShell(t, 2)
+	a, b := servers[0].Addr(), servers[1].Addr()
+
+	input := strings.Join([]string{
+		// the hosts are added once the shell started
+		"echo all",
+		":add " + a + " " + b,
+		"echo all",
+		":group grp " + a,
+		":use grp," + b,
+		":use grp",
+		"echo grp",
+		":use all",
+		":off " + b,
+		"echo on",
+		":on " + b,
+		":remove " + a,
+		"echo remaining",
+		":use grp,nosuchhost",
+		":status",
+		":quit",
+		"echo after quit",
+	}, "\n")
+	var out bytes.Buffer
+	if err := sh.loop(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[*sshtest.Server][]string{
+		servers[0]: {"echo all", "echo grp", "echo on"},
+		servers[1]: {"echo all", "echo remaining"},
+	}
+	for s, cmds := range expected {
+		if got := s.Commands(); strings.Join(got, ";") != strings.Join(cmds, ";") {
+			t.Errorf("expected the commands %q on %s, got %q", cmds, s.Addr(), got)
+		}
+	}
+	if !strings.Contains(out.String(), "slex [grp,"+b+"]> ") {
+		t.Errorf("expected the group and the host to be used together, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "unknown host or group nosuchhost") {
+		t.Errorf("expected the unknown host to be rejected, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), b+": 0\n") || strings.Contains(out.String(), a+":") {
+		t.Errorf("expected the status of the remaining host only, got:\n%s", out.String())
+	}
+}
+
+func TestShellReconnect(t *testing.T) {
+	sh, servers := newTestShell(t, 1)
+	addr := servers[0].Addr()
+	sh.add([]string{addr})
+
+	if err := sh.loop(strings.NewReader("echo first\n"), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	h := sh.hosts[addr]
+	h.mu.Lock()
+	dropped := h.client
+	h.mu.Unlock()
+	if dropped == nil {
+		t.Fatal("expected the connection to be kept open")
+	}
+	// the next line reconnects once the connection is lost
+	dropped.Close()
+
+	var out bytes.Buffer
+	if err := sh.loop(strings.NewReader("echo second\n:status\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if cmds := servers[0].Commands(); len(cmds) != 2 || cmds[1] != "echo second" {
+		t.Errorf("expected the command to run after reconnecting, got %q", cmds)
+	}
+	if !strings.Contains(out.String(), addr+": 0\n") {
+		t.Errorf("expected the command to succeed, got:\n%s", out.String())
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.client == nil || h.client == dropped {
+		t.Error("expected a new connection")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// socksHandshake reads the greeting and the CONNECT request of a SOCKS5
+// client, without authentication, and returns the requested address.
+func socksHandshake(c net.Conn) (string, error) {
+	buf := make([]byte, 258)
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 5 {
+		return "", fmt.Errorf("unsupported socks version %d", buf[0])
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return "", err
+	}
+	// no authentication required
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return "", err
+	}
+
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[1] != 1 {
+		c.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unsupported socks command %d", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(c, buf[:1]); err != nil {
+			return "", err
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(c, buf[:n]); err != nil {
+			return "", err
+		}
+		host = string(buf[:n])
+	case 4:
+		if _, err := io.ReadFull(c, buf[:16]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		c.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unsupported socks address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socksReply tells the SOCKS5 client whether the connection was established.
+func socksReply(c net.Conn, err error) {
+	status := byte(0)
+	if err != nil {
+		status = 5 // connection refused
+	}
+	c.Write([]byte{5, status, 0, 1, 0, 0, 0, 0, 0, 0})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// The outcome of a host in the state of a run.
+const (
+	hostPending   = "pending"
+	hostRunning   = "running"
+	hostOK        = "ok"
+	hostFailed    = "failed"
+	hostUnreached = "unreached"
+)
+
+// hostState is the outcome of a host in a run.
+type hostState struct {
+	Host   string            `json:"host"`
+	Vars   map[string]string `json:"vars,omitempty"`
+	Status string            `json:"status"`
+	Error  string            `json:"error,omitempty"`
+	// OutputFile is the file of the output of the host once it finished,
+	// relative to the directory of the state file, when the output is saved
+	OutputFile string `json:"output_file,omitempty"`
+}
+
+// runState records the outcome of each host of a run so that the hosts
+// that did not succeed can be run again. It's saved as each host finishes
+// so that it's up to date when the run is interrupted.
+type runState struct {
+	path string
+	// jobs are the indexes in Hosts of the hosts of the jobs
+	jobs []int
+	// rerun are the indexes in Hosts of the hosts selected to run again,
+	// in the order of the hosts returned by rerunHosts
+	rerun []int
+	// saveOutput saves the output of each host in its own file as it finishes
+	saveOutput bool
+
+	mu       sync.Mutex
+	Started  time.Time    `json:"started"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Hosts    []*hostState `json:"hosts"`
+}
+
+// statePath returns the state file of the --state flag, or the state file
+// of the last run under $XDG_STATE_HOME, ~/.local/state by default. The
+// subcommands have their own last run so that they don't replace the one
+// of the commands.
+func statePath(context *cli.Context) (string, error) {
+	if path := context.GlobalString("state"); path != "" {
+		return path, nil
+	}
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := homeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	name := "last-run.json"
+	if context.Command.Name != "" {
+		name = fmt.Sprintf("last-%s-run.json", context.Command.Name)
+	}
+	return filepath.Join(dir, "slex", name), nil
+}
+
+// loadState reads the state of a run from the file.
+func loadState(path string) (*runState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no previous run recorded in %s", path)
+		}
+		return nil, err
+	}
+	s := &runState{path: path}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid state file %s - %v", path, err)
+	}
+	return s, nil
+}
+
+// rerunHosts returns the state of the previous run and its hosts selected by the
+// --rerun-failed, --rerun-unreached and --resume flags with their variables.
+// The state is nil when none of the flags is set.
+func rerunHosts(context *cli.Context) (previous *runState, hosts []string, vars map[string]map[string]string, err error) {
+	selected := make(map[string]bool)
+	if context.GlobalBool("rerun-failed") {
+		selected[hostFailed] = true
+	}
+	if context.GlobalBool("rerun-unreached") {
+		selected[hostUnreached] = true
+	}
+	if context.GlobalBool("resume") {
+		// hosts that were not started or were interrupted
+		selected[hostPending] = true
+		selected[hostRunning] = true
+	}
+	if len(selected) == 0 {
+		return nil, nil, nil, nil
+	}
+
+	path, err := statePath(context)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s, err := loadState(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vars = make(map[string]map[string]string)
+	for i, h := range s.Hosts {
+		if selected[h.Status] {
+			s.rerun = append(s.rerun, i)
+			hosts = append(hosts, h.Host)
+			if h.Vars != nil {
+				vars[h.Host] = h.Vars
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, nil, nil, fmt.Errorf("no hosts to run again in %s", path)
+	}
+	log.Debugf("running %d hosts of the previous run again from %s", len(hosts), path)
+	return s, hosts, vars, nil
+}
+
+// newRunState returns the state of a run of the hosts, all pending. Each job has
+// its own entry, even when a host is given more than once. When the hosts are run
+// again from the state of a previous run, they reuse the entries selected by
+// rerunHosts and the outcome of the other hosts is kept so that they can still be
+// run again later.
+func newRunState(path string, hosts []string, vars map[string]map[string]string, previous *runState) *runState {
+	s := previous
+	if s == nil {
+		s = &runState{}
+	}
+	s.path = path
+	s.Started = time.Now()
+	s.Finished = nil
+	s.jobs = nil
+
+	for n, h := range hosts {
+		i := len(s.Hosts)
+		if n < len(s.rerun) {
+			i = s.rerun[n]
+		} else {
+			s.Hosts = append(s.Hosts, &hostState{Host: h})
+		}
+		s.Hosts[i].Vars = vars[h]
+		s.Hosts[i].Status = hostPending
+		s.Hosts[i].Error = ""
+		s.Hosts[i].OutputFile = ""
+		s.jobs = append(s.jobs, i)
+	}
+	s.rerun = nil
+	return s
+}
+
+// save writes the state to the state file.
+func (s *runState) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saveLocked()
+}
+
+// update sets the outcome of the job's host and saves the state once the
+// host finished, --resume runs the pending and running hosts alike.
+func (s *runState) update(j *job) {
+	i := s.jobs[j.index]
+	j.mu.Lock()
+	var lines []string
+	if j.state == finished && s.saveOutput {
+		lines = append([]string{}, j.lines...)
+	}
+	j.mu.Unlock()
+	// the output of the host is written on its own, without the state
+	var output string
+	if lines != nil {
+		output = fmt.Sprintf("%d-%s.log", i, unsafeFileChars.ReplaceAllString(j.name, "_"))
+		if err := writeLines(filepath.Join(s.outputDir(), output), lines); err != nil {
+			log.Warnf("saving the output of %s failed - %v", j.name, err)
+			output = ""
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.Hosts[i]
+	h.OutputFile = output
+	j.mu.Lock()
+	state := j.state
+	switch {
+	case j.state != finished:
+		h.Status = hostRunning
+	case j.err == nil:
+		h.Status = hostOK
+	case j.connected:
+		h.Status, h.Error = hostFailed, j.err.Error()
+	default:
+		h.Status, h.Error = hostUnreached, j.err.Error()
+	}
+	j.mu.Unlock()
+	if state == finished {
+		s.saveLocked()
+	}
+}
+
+// finish records the end of the run and saves the state.
+func (s *runState) finish() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.Finished = &now
+	if err := s.write(); err != nil {
+		return fmt.Errorf("saving the state of the run to %s failed - %v", s.path, err)
+	}
+	return nil
+}
+
+// saveLocked writes the state to a temporary file renamed over the state file
+// so that the state file is complete when the run is interrupted while saving.
+// Failing to save is not fatal to the run.
+func (s *runState) saveLocked() {
+	if err := s.write(); err != nil {
+		log.Warnf("saving the state of the run to %s failed - %v", s.path, err)
+	}
+}
+
+// outputDir is the directory of the output of the hosts, named after the state file.
+func (s *runState) outputDir() string {
+	return strings.TrimSuffix(s.path, filepath.Ext(s.path)) + ".output"
+}
+
+// output returns the lines of the output of the host saved in the state,
+// nil when its output was not saved.
+func (s *runState) output(h *hostState) ([]string, error) {
+	if h.OutputFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.outputDir(), h.OutputFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), nil
+}
+
+// writeLines writes the lines to the file, each followed by a new line.
+func writeLines(path string, lines []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0600)
+}
+
+func (s *runState) write() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
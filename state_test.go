@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "slex", "last-run.json")
+
+	hosts := []string{"ok", "failed", "unreached", "running", "pending"}
+	vars := map[string]map[string]string{"failed": {"role": "db"}}
+	s := newRunState(path, hosts, vars, nil)
+	s.save()
+
+	jobs := []*job{
+		{index: 0, state: finished},
+		{index: 1, state: finished, err: errors.New("exit 1"), connected: true},
+		{index: 2, state: finished, err: errors.New("refused")},
+		{index: 3, state: running},
+	}
+	for _, j := range jobs {
+		s.update(j)
+	}
+	s.finish()
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Finished == nil {
+		t.Error("expected the run to be finished")
+	}
+	expected := []string{hostOK, hostFailed, hostUnreached, hostRunning, hostPending}
+	for i, h := range loaded.Hosts {
+		if h.Host != hosts[i] || h.Status != expected[i] {
+			t.Errorf("expected %s %s, got %s %s", hosts[i], expected[i], h.Host, h.Status)
+		}
+	}
+	if h := loaded.Hosts[1]; h.Error != "exit 1" || h.Vars["role"] != "db" {
+		t.Errorf("expected the error and variables of the host, got %+v", h)
+	}
+
+	// running the failed host again keeps the outcome of the other hosts
+	loaded.rerun = []int{1}
+	s = newRunState(path, []string{"failed", "new"}, nil, loaded)
+	s.update(&job{index: 0, state: finished})
+	s.update(&job{index: 1, state: running})
+	expected = []string{hostOK, hostOK, hostUnreached, hostRunning, hostPending, hostRunning}
+	if len(s.Hosts) != len(expected) {
+		t.Fatalf("expected %d hosts, got %d", len(expected), len(s.Hosts))
+	}
+	for i, h := range s.Hosts {
+		if h.Status != expected[i] {
+			t.Errorf("expected %s %s, got %s", h.Host, expected[i], h.Status)
+		}
+	}
+
+	if _, err := loadState(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error for a missing state file")
+	}
+}
+
+func TestRunStateDuplicateHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.json")
+
+	s := newRunState(path, []string{"web", "web"}, nil, nil)
+	s.update(&job{index: 0, state: finished})
+	s.update(&job{index: 1, state: finished, err: errors.New("exit 1"), connected: true})
+	if len(s.Hosts) != 2 || s.Hosts[0].Status != hostOK || s.Hosts[1].Status != hostFailed {
+		t.Fatalf("expected an entry for each job, got %+v %+v", s.Hosts[0], s.Hosts[len(s.Hosts)-1])
+	}
+
+	// running the second job again updates its own entry
+	s.rerun = []int{1}
+	s = newRunState(path, []string{"web"}, nil, s)
+	s.update(&job{index: 0, state: finished})
+	if s.Hosts[0].Status != hostOK || s.Hosts[1].Status != hostOK || s.Hosts[1].Error != "" {
+		t.Errorf("expected both entries to succeed, got %+v %+v", s.Hosts[0], s.Hosts[1])
+	}
+}
+
+func TestRunStateOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.json")
+
+	s := newRunState(path, []string{"web1", "web2", "web3"}, nil, nil)
+	s.saveOutput = true
+	s.update(&job{name: "web1", index: 0, state: finished, lines: []string{"a", "", "b"}})
+	s.update(&job{name: "web2", index: 1, state: finished})
+	s.update(&job{name: "web3", index: 2, state: running, lines: []string{"partial"}})
+
+	loaded, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range [][]string{{"a", "", "b"}, {}, nil} {
+		lines, err := loaded.output(loaded.Hosts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("expected the output of %s to be %q, got %q", loaded.Hosts[i].Host, expected, lines)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	units "github.com/docker/go-units"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var errReaderClosed = errors.New("stdin reader closed")
+
+// newStdinSource returns the stdin streamed to the command on each host or nil
+// when neither the local stdin nor per-host stdin files are used.
+// The local stdin is streamed with --stdin or when it's not a terminal
+// and no host is attached.
+func newStdinSource(context *cli.Context) (*stdinSource, error) {
+	files := make(map[string]string)
+	for _, v := range context.GlobalStringSlice("stdin-file") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid stdin file format %s", v)
+		}
+		files[parts[0]] = parts[1]
+	}
+
+	// the local stdin belongs to the attached host
+	stream := context.GlobalBool("stdin") ||
+		!context.GlobalBool("no-stdin") && context.GlobalString("attach") == "" &&
+			!terminal.IsTerminal(int(os.Stdin.Fd()))
+	if !stream {
+		if len(files) == 0 {
+			return nil, nil
+		}
+		return &stdinSource{files: files}, nil
+	}
+
+	limit, err := units.RAMInBytes(context.GlobalString("stdin-buffer"))
+	if err != nil {
+		return nil, err
+	}
+	spool, err := newStdinSpool(os.Stdin, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &stdinSource{
+		spool: spool,
+		files: files,
+	}, nil
+}
+
+// stdinSource provides the stdin of the command on each host, either from
+// the host's stdin file or from the spooled local stdin.
+type stdinSource struct {
+	spool *stdinSpool
+	// files maps hosts to the file used as their stdin
+	files map[string]string
+}
+
+// open returns the stdin for the host, nil is returned when the host has no stdin.
+func (s *stdinSource) open(host string) (io.ReadCloser, error) {
+	if file, ok := s.files[host]; ok {
+		return os.Open(file)
+	}
+	if s.spool == nil {
+		return nil, nil
+	}
+	return s.spool.newReader(), nil
+}
+
+// Close removes the spooled local stdin.
+func (s *stdinSource) Close() error {
+	if s.spool == nil {
+		return nil
+	}
+	return s.spool.Close()
+}
+
+// stdinSpool copies the local stdin to a temporary file so that hosts starting
+// later, because of the concurrency limit, still receive all of it. Reading the
+// local stdin pauses while the slowest running host is more than limit bytes
+// behind, hosts that are not running yet read from the file when they start.
+type stdinSpool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	f       *os.File
+	written int64
+	done    bool
+	err     error
+	limit   int64
+	readers map[*spoolReader]struct{}
+}
+
+func newStdinSpool(r io.Reader, limit int64) (*stdinSpool, error) {
+	// the spool would wait for the readers before reading anything
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid stdin buffer size %d, it must be greater than zero", limit)
+	}
+	f, err := ioutil.TempFile("", "slex-stdin")
+	if err != nil {
+		return nil, err
+	}
+	s := &stdinSpool{
+		f:       f,
+		limit:   limit,
+		readers: make(map[*spoolReader]struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.fill(r)
+	return s, nil
+}
+
+// fill copies r to the spool file until EOF.
+func (s *stdinSpool) fill(r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		s.mu.Lock()
+		for s.behind() >= s.limit && !s.done {
+			s.cond.Wait()
+		}
+		if s.done {
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := s.f.WriteAt(buf[:n], s.written); werr != nil && err == nil {
+				err = werr
+			}
+		}
+
+		s.mu.Lock()
+		s.written += int64(n)
+		if err != nil {
+			s.done = true
+			if err != io.EOF {
+				s.err = err
+			}
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// behind returns how many bytes the slowest reader is behind the spool.
+func (s *stdinSpool) behind() int64 {
+	var max int64
+	for r := range s.readers {
+		if b := s.written - r.off; b > max {
+			max = b
+		}
+	}
+	return max
+}
+
+func (s *stdinSpool) newReader() *spoolReader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &spoolReader{s: s}
+	s.readers[r] = struct{}{}
+	return r
+}
+
+// Close stops reading the local stdin and removes the spool file.
+func (s *stdinSpool) Close() error {
+	s.mu.Lock()
+	s.done = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
+
+// spoolReader reads the spooled stdin from the start for a single host.
+type spoolReader struct {
+	s      *stdinSpool
+	off    int64
+	closed bool
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	s := r.s
+	s.mu.Lock()
+	for r.off >= s.written && !s.done && !r.closed {
+		s.cond.Wait()
+	}
+	if r.closed {
+		s.mu.Unlock()
+		return 0, errReaderClosed
+	}
+	if r.off >= s.written {
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if max := s.written - r.off; int64(len(p)) > max {
+		p = p[:max]
+	}
+	s.mu.Unlock()
+
+	n, err := s.f.ReadAt(p, r.off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+
+	s.mu.Lock()
+	r.off += int64(n)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return n, err
+}
+
+// Close stops the reader so that the spool no longer waits for it.
+func (r *spoolReader) Close() error {
+	s := r.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.closed = true
+	delete(s.readers, r)
+	s.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStdinSpool(t *testing.T) {
+	in := bytes.Repeat([]byte("slex"), 64*1024)
+	s, err := newStdinSpool(bytes.NewReader(in), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Readers started before and after the input is spooled receive all of it.
+	first := s.newReader()
+	out, err := ioutil.ReadAll(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, out) {
+		t.Errorf("first reader received %d bytes, expected %d", len(out), len(in))
+	}
+	first.Close()
+
+	second := s.newReader()
+	defer second.Close()
+	out, err = ioutil.ReadAll(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, out) {
+		t.Errorf("second reader received %d bytes, expected %d", len(out), len(in))
+	}
+}
+
+func TestStdinSpoolReaderClose(t *testing.T) {
+	s, err := newStdinSpool(bytes.NewReader(bytes.Repeat([]byte("x"), 64*1024)), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A reader that stops reading must not hold back the others once closed.
+	slow := s.newReader()
+	fast := s.newReader()
+	slow.Close()
+	if _, err := slow.Read(make([]byte, 1)); err != errReaderClosed {
+		t.Errorf("expected closed reader error, got %v", err)
+	}
+	out, err := ioutil.ReadAll(fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 64*1024 {
+		t.Errorf("fast reader received %d bytes, expected %d", len(out), 64*1024)
+	}
+}
+
+func TestStdinSpoolLimit(t *testing.T) {
+	for _, limit := range []int64{0, -1} {
+		if s, err := newStdinSpool(bytes.NewReader([]byte("x")), limit); err == nil {
+			s.Close()
+			t.Errorf("expected an error for the buffer size %d", limit)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/urfave/cli"
+)
+
+// stepResult is the outcome of a single step executed on a host.
+type stepResult struct {
+	// name is the name of the step of a runbook, cmd the command of --cmd
+	name     string
+	cmd      string
+	err      error
+	duration time.Duration
+	// skipped is true when the condition of the step was false
+	skipped bool
+	// ignored is true when the error does not fail the host
+	ignored bool
+}
+
+// loadSteps returns the commands passed with --cmd followed by the ones in
+// the --cmd-file, one per line, ignoring blank lines and comments.
+func loadSteps(context *cli.Context) ([]string, error) {
+	steps := []string(context.GlobalStringSlice("cmd"))
+	if file := context.GlobalString("cmd-file"); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			steps = append(steps, line)
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// stepError is the error of the step that failed on a host, the error of the
+// command stays reachable with errors.As to check its exit status.
+type stepError struct {
+	name string
+	err  error
+}
+
+func (e *stepError) Error() string {
+	return fmt.Sprintf("%s: %v", e.name, e.err)
+}
+
+func (e *stepError) Unwrap() error {
+	return e.err
+}
+
+// runSteps executes the steps in order over the connection of the session, each
+// in a new session. It stops at the first step that fails on the host. The stdin
+// of the command is streamed to the first step.
+func runSteps(job *job, session *runner.Session, c command, steps []string, quiet bool) error {
+	for i, step := range steps {
+		s := session
+		if i > 0 {
+			var err error
+			if s, err = session.NewSession(); err != nil {
+				return err
+			}
+		}
+		job.setProgress("step %d/%d", i+1, len(steps))
+
+		c.Cmd = step
+		if i > 0 {
+			c.Stdin = nil
+		}
+		start := time.Now()
+		err := runSSH(job, s, c, quiet)
+		job.addStep(stepResult{
+			cmd:      step,
+			err:      err,
+			duration: time.Since(start),
+		})
+		if i > 0 {
+			s.Session.Close()
+		}
+		if err != nil {
+			return &stepError{name: fmt.Sprintf("step %d %q", i+1, step), err: err}
+		}
+	}
+	return nil
+}
+
+// printStepSummary writes the result and duration of each step for all the jobs.
+func printStepSummary(w io.Writer, jobs []*job, steps []string) {
+	tw := tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTEP\tSTATUS\tTIME\tCOMMAND")
+	for _, j := range jobs {
+		for i, step := range steps {
+			status, duration := "SKIPPED", "-"
+			if i < len(j.steps) {
+				status = "OK"
+				if err := j.steps[i].err; err != nil {
+					status = fmt.Sprintf("ERROR %s", err)
+				}
+				duration = j.steps[i].duration.Round(time.Millisecond).String()
+			} else if i == 0 && j.err != nil {
+				status = fmt.Sprintf("ERROR %s", j.err)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", j.name, i+1, status, duration, step)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/crosbymichael/slex/pkg/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSession returns a session with a server of the tests executing the
+// commands with the handler.
+func newTestSession(t *testing.T, handler sshtest.Handler) *runner.Session {
+	client := newTestClient(t, sshtest.Config{Handler: handler})
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &runner.Session{Client: client, Session: session}
+}
+
+// newTestJob returns a job of the host whose signals are drained until the test ends.
+func newTestJob(t *testing.T, name string) *job {
+	j := &job{name: name, host: name, state: running, signal: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range j.signal {
+		}
+	}()
+	t.Cleanup(func() {
+		close(j.signal)
+		<-done
+	})
+	return j
+}
+
+func TestRunSteps(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		stdin = make(map[string]string)
+	)
+	session := newTestSession(t, func(e *sshtest.Exec) int {
+		data, _ := ioutil.ReadAll(e.Stdin)
+		mu.Lock()
+		stdin[e.Command] = string(data)
+		mu.Unlock()
+		if e.Command == "false" {
+			return 1
+		}
+		return 0
+	})
+	file := filepath.Join(t.TempDir(), "stdin")
+	if err := ioutil.WriteFile(file, []byte("input"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j := newTestJob(t, "web1")
+	c := command{Stdin: &stdinSource{files: map[string]string{"web1": file}}}
+	steps := []string{"cat", "true", "false", "never"}
+
+	err := runSteps(j, session, c, steps, true)
+	var exit *ssh.ExitError
+	if err == nil || !strings.Contains(err.Error(), `step 3 "false"`) || !errors.As(err, &exit) || exit.ExitStatus() != 1 {
+		t.Fatalf("expected the third step to fail with its exit status, got %v", err)
+	}
+	j.err = err
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := map[string]string{"cat": "input", "true": "", "false": ""}
+	if len(stdin) != len(expected) {
+		t.Errorf("expected the steps to stop at the failing step, got %v", stdin)
+	}
+	for cmd, in := range expected {
+		if got, ok := stdin[cmd]; !ok || got != in {
+			t.Errorf("expected the stdin of %s to be %q, got %q", cmd, in, got)
+		}
+	}
+
+	var out bytes.Buffer
+	printStepSummary(&out, []*job{j}, steps)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected a row for each step, got:\n%s", out.String())
+	}
+	for i, status := range []string{"OK", "OK", "ERROR Process exited with status 1", "SKIPPED"} {
+		fields := strings.Fields(lines[i+1])
+		if fields[0] != "web1" || fields[len(fields)-1] != steps[i] || !strings.Contains(lines[i+1], status) {
+			t.Errorf("expected step %d to be %s, got %q", i+1, status, lines[i+1])
+		}
+	}
+}
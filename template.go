@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// hostData is passed to the command template to render the command of a host.
+type hostData struct {
+	// Host is the host as it was specified by the user
+	Host string
+	// Addr is the host address that is connected to
+	Addr string
+	Port string
+	User string
+	// Index is the position of the host in the hosts of the run
+	Index int
+	// Vars are the variables of the host from the hosts file
+	Vars map[string]string
+	// Env are the environment variables set with -e for the command on the
+	// host, the local environment is read with the env function
+	Env map[string]string
+}
+
+// templateFuncs are the functions of the command templates.
+var templateFuncs = template.FuncMap{
+	// env returns the value of the local environment variable
+	"env": os.Getenv,
+}
+
+// hostData returns the template data of the job once its address and user are resolved.
+func (m *multiplexer) hostData(j *job, c command) hostData {
+	addr, port, err := net.SplitHostPort(j.host)
+	if err != nil {
+		addr = j.host
+	}
+	vars := j.vars
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	return hostData{
+		Host:  j.name,
+		Addr:  addr,
+		Port:  port,
+		User:  j.user,
+		Index: j.index,
+		Vars:  vars,
+		Env:   c.Env,
+	}
+}
+
+func newCommandTemplate(text string) (*template.Template, error) {
+	return template.New("command").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// parseTemplates checks the command and the steps are valid templates
+// so that errors are reported before connecting to the hosts.
+func (c command) parseTemplates() error {
+	for _, text := range append([]string{c.Cmd}, c.Steps...) {
+		if _, err := newCommandTemplate(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forHost returns the command with the command and the steps rendered with the
+// data of the host, the command is returned unchanged when Template is not set.
+func (c command) forHost(data hostData) (command, error) {
+	if !c.Template {
+		return c, nil
+	}
+	var err error
+	if c.Cmd, err = renderCommand(c.Cmd, data); err != nil {
+		return c, err
+	}
+	steps := make([]string, len(c.Steps))
+	for i, step := range c.Steps {
+		if steps[i], err = renderCommand(step, data); err != nil {
+			return c, err
+		}
+	}
+	c.Steps = steps
+	return c, nil
+}
+
+func renderCommand(text string, data hostData) (string, error) {
+	t, err := newCommandTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandForHost(t *testing.T) {
+	t.Setenv("SLEX_TEMPLATE_TEST", "local")
+	m := &multiplexer{}
+	j := &job{name: "web1", host: "10.0.0.1:2222", user: "deploy", index: 3, vars: map[string]string{"x": "42"}}
+	data := m.hostData(j, command{Env: map[string]string{"LANG": "C"}})
+
+	for _, tc := range []struct {
+		name     string
+		cmd      string
+		steps    []string
+		template bool
+		expected string
+		// err is a part of the expected error
+		err string
+	}{
+		{name: "host", cmd: "echo {{.Host}} {{.Addr}}", template: true, expected: "echo web1 10.0.0.1"},
+		{name: "port and user", cmd: "{{.User}}@{{.Port}} #{{.Index}}", template: true, expected: "deploy@2222 #3"},
+		{name: "vars", cmd: "echo {{.Vars.x}}", template: true, expected: "echo 42"},
+		{name: "env", cmd: `echo {{env "SLEX_TEMPLATE_TEST"}} {{.Env.LANG}}`, template: true, expected: "echo local C"},
+		{name: "not a template", cmd: "echo {{.Host}}", expected: "echo {{.Host}}"},
+		{name: "steps", cmd: "true", steps: []string{"echo {{.Host}}", "echo {{.Vars.x}}"}, template: true, expected: "true"},
+		{name: "missing var", cmd: "echo {{.Vars.missing}}", template: true, err: `map has no entry for key "missing"`},
+		{name: "missing var in a step", cmd: "true", steps: []string{"echo {{.Vars.missing}}"}, template: true, err: "missing"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := command{Cmd: tc.cmd, Steps: tc.steps, Template: tc.template}
+			if err := c.parseTemplates(); err != nil {
+				t.Fatal(err)
+			}
+			rendered, err := c.forHost(data)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rendered.Cmd != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, rendered.Cmd)
+			}
+			if tc.steps != nil && !reflect.DeepEqual(rendered.Steps, []string{"echo web1", "echo 42"}) {
+				t.Errorf("unexpected steps %q", rendered.Steps)
+			}
+		})
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	for _, c := range []command{
+		{Cmd: "echo {{.Host"},
+		{Cmd: "true", Steps: []string{"echo {{nosuchfunc}}"}},
+	} {
+		if err := c.parseTemplates(); err == nil {
+			t.Errorf("expected %q %q to be rejected", c.Cmd, c.Steps)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/pkg/progress"
+	"golang.org/x/crypto/ssh"
+)
+
+// progressInterval limits how often the transfer progress of a job is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// progressReader reports the bytes read through it as the progress of the job.
+type progressReader struct {
+	io.Reader
+	job   *job
+	name  string
+	total int64
+	n     int64
+	last  time.Time
+}
+
+func newProgressReader(r io.Reader, j *job, name string, total int64) *progressReader {
+	return &progressReader{
+		Reader: r,
+		job:    j,
+		name:   name,
+		total:  total,
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if err != nil || time.Since(r.last) > progressInterval {
+		r.last = time.Now()
+		r.job.setProgress("%s %s/%s", r.name, progress.Bytes(r.n), progress.Bytes(r.total))
+	}
+	return n, err
+}
+
+// runRemote executes cmd in a new session on the client and returns
+// the output of the command in the error when it fails.
+func runRemote(client *ssh.Client, cmd string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var out bytes.Buffer
+	session.Stdout, session.Stderr = &out, &out
+	if err := session.Run(cmd); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("%s: %v: %s", cmd, err, msg)
+		}
+		return fmt.Errorf("%s: %v", cmd, err)
+	}
+	return nil
+}
+
+// tempName returns a hidden path next to target that a file is written to
+// before being renamed into place.
+func tempName(target string) string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return path.Join(path.Dir(target), fmt.Sprintf(".%s.slex-%d", path.Base(target), time.Now().UnixNano()))
+	}
+	return path.Join(path.Dir(target), fmt.Sprintf(".%s.slex-%s", path.Base(target), hex.EncodeToString(b)))
+}
+
+// unixMode returns the permission bits of mode in their unix representation,
+// which is what the sftp and scp protocols transfer.
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// requestTTY returns true when a pseudo terminal should be requested for the command
+// based on the RequestTTY client option. When attached, a terminal is requested unless
+// disabled as long as the local stdin is a terminal, like ssh does for interactive sessions.
+func requestTTY(options sshconfig.ClientOptions, attached bool) bool {
+	switch strings.ToLower(options.RequestTTY) {
+	case "yes", "force":
+		return true
+	case "no":
+		return false
+	default:
+		return attached && terminal.IsTerminal(int(os.Stdin.Fd()))
+	}
+}
+
+// terminalSize returns the size of the local terminal, 80x24 when stdin is not a terminal.
+func terminalSize() (width, height int) {
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		if w, h, err := terminal.GetSize(fd); err == nil {
+			return w, h
+		}
+	}
+	return 80, 24
+}
+
+// requestPty requests a pseudo terminal for the session with the size of the
+// local terminal, or 80x24 when the local stdin is not a terminal.
+func requestPty(session *runner.Session) error {
+	w, h := terminalSize()
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm"
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	return session.RequestPty(term, h, w, modes)
+}
+
+// forwardWindowSize changes the window size of the session to the size returned
+// by size each time a signal is received until the returned function is called.
+func forwardWindowSize(sigs <-chan os.Signal, size func() (width, height int, err error), session *runner.Session) func() {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				w, h, err := size()
+				if err != nil {
+					continue
+				}
+				if err := session.WindowChange(h, w); err != nil {
+					log.Debugf("failed to change the window size - %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// attach connects the local terminal to the session running the command until it exits.
+// The progress of the other hosts is not rendered while the terminal is attached.
+func (m *multiplexer) attach(job *job, session *runner.Session, c command) error {
+	m.setAttached(true)
+	defer m.setAttached(false)
+
+	fd := int(os.Stdin.Fd())
+	if requestTTY(session.Options, true) {
+		if err := requestPty(session); err != nil {
+			return err
+		}
+		if terminal.IsTerminal(fd) {
+			state, err := terminal.MakeRaw(fd)
+			if err != nil {
+				return err
+			}
+			defer terminal.Restore(fd, state)
+
+			stop := watchWindowSize(fd, session)
+			defer stop()
+		}
+	}
+	// the output is kept like the output of the other hosts for
+	// the expectations, the diffs and the recording
+	out := &writer{
+		j:        job,
+		cast:     job.recording(),
+		attached: true,
+	}
+	session.Stdout, session.Stderr = io.MultiWriter(os.Stdout, out), io.MultiWriter(os.Stderr, out)
+
+	for key, value := range c.Env {
+		if err := session.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	// The stdin pipe is used so that the session does not wait for
+	// the next read from the local terminal once the command exits.
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	detached := make(chan struct{})
+	defer close(detached)
+	go localStdin.copy(w, detached)
+
+	log.Debugf("attached to %s", job.host)
+	if c.Become != nil {
+		return session.Run(c.Become.wrap(c.Cmd, true))
+	}
+	return session.Run(c.Cmd)
+}
+
+// localStdin is the local stdin read by the attached sessions.
+var localStdin = &stdinReader{r: os.Stdin}
+
+// stdinReader reads in the background so that copying its input stops as soon as
+// the attached session ends instead of at the next read, which may never return.
+// The input read after the session ended is kept for the next copy.
+type stdinReader struct {
+	r    io.Reader
+	once sync.Once
+	data chan []byte
+}
+
+// copy writes the input to w until the input ends or detached is closed, then closes w.
+func (s *stdinReader) copy(w io.WriteCloser, detached <-chan struct{}) {
+	defer w.Close()
+	s.once.Do(func() {
+		s.data = make(chan []byte)
+		go s.read()
+	})
+	for {
+		select {
+		case <-detached:
+			return
+		case p, ok := <-s.data:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(p); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *stdinReader) read() {
+	defer close(s.data)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := s.r.Read(buf)
+		if n > 0 {
+			s.data <- buf[:n]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
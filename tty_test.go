@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/crosbymichael/slex/pkg/sshconfig"
+	"github.com/crosbymichael/slex/pkg/sshtest"
+)
+
+func TestRequestTTY(t *testing.T) {
+	for _, tc := range []struct {
+		requestTTY string
+		attached   bool
+		expected   bool
+	}{
+		{requestTTY: "yes", expected: true},
+		{requestTTY: "force", expected: true},
+		{requestTTY: "Yes", expected: true},
+		{requestTTY: "no", attached: true, expected: false},
+		{requestTTY: "", expected: false},
+		// the stdin of the tests is not a terminal
+		{requestTTY: "auto", attached: true, expected: false},
+	} {
+		if got := requestTTY(sshconfig.ClientOptions{RequestTTY: tc.requestTTY}, tc.attached); got != tc.expected {
+			t.Errorf("RequestTTY %q attached %t: expected %t, got %t", tc.requestTTY, tc.attached, tc.expected, got)
+		}
+	}
+}
+
+func TestRequestPty(t *testing.T) {
+	t.Setenv("TERM", "vt100")
+	execs := make(chan sshtest.Exec, 1)
+	session := newTestSession(t, func(e *sshtest.Exec) int {
+		execs <- *e
+		return 0
+	})
+	if err := requestPty(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Run("tty"); err != nil {
+		t.Fatal(err)
+	}
+	e := <-execs
+	w, h := terminalSize()
+	if !e.Pty || e.Term != "vt100" || e.Size != (sshtest.WindowSize{Width: w, Height: h}) {
+		t.Errorf("expected a %dx%d vt100 pseudo terminal, got pty %t %q %+v", w, h, e.Pty, e.Term, e.Size)
+	}
+}
+
+func TestForwardWindowSize(t *testing.T) {
+	session := newTestSession(t, func(e *sshtest.Exec) int {
+		select {
+		case size := <-e.WindowChanges:
+			fmt.Fprintf(e.Stdout, "%dx%d", size.Width, size.Height)
+			return 0
+		case <-time.After(5 * time.Second):
+			return 1
+		}
+	})
+	if err := requestPty(session); err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("resize"); err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal, 1)
+	stop := forwardWindowSize(sigs, func() (int, int, error) {
+		return 132, 43, nil
+	}, session)
+	defer stop()
+	sigs <- os.Interrupt
+
+	out, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatalf("expected the window change to reach the command - %v", err)
+	}
+	if string(out) != "132x43" {
+		t.Errorf("expected the size of the local terminal, got %q", out)
+	}
+}
+
+// sessionStdin receives the writes of stdinReader.copy like the stdin of a session.
+type sessionStdin struct {
+	data   chan string
+	closed chan struct{}
+}
+
+func newSessionStdin() *sessionStdin {
+	return &sessionStdin{data: make(chan string, 1), closed: make(chan struct{})}
+}
+
+func (s *sessionStdin) Write(p []byte) (int, error) {
+	s.data <- string(p)
+	return len(p), nil
+}
+
+func (s *sessionStdin) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func TestStdinReaderDetach(t *testing.T) {
+	r, w := io.Pipe()
+	s := &stdinReader{r: r}
+
+	first := newSessionStdin()
+	detached := make(chan struct{})
+	go s.copy(first, detached)
+	go w.Write([]byte("ls\n"))
+	if p := <-first.data; p != "ls\n" {
+		t.Errorf("unexpected input %q", p)
+	}
+	// the copy stops when the session ends while the stdin is still open
+	close(detached)
+	select {
+	case <-first.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the copy to stop once detached")
+	}
+
+	// the input read afterwards goes to the next session
+	go w.Write([]byte("exit\n"))
+	second := newSessionStdin()
+	go s.copy(second, make(chan struct{}))
+	if p := <-second.data; p != "exit\n" {
+		t.Errorf("expected the input to be copied to the next session, got %q", p)
+	}
+	w.Close()
+	select {
+	case <-second.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the copy to stop at the end of the input")
+	}
+}
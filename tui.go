@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-colorable"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// key is a key pressed in the terminal UI, a rune or one of the special keys.
+type key rune
+
+const (
+	keyUp key = -(iota + 1)
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyEscape
+	keyEnter
+	keyBackspace
+	keyInterrupt
+)
+
+// parseKeys returns the keys of the input read from a terminal in raw mode.
+// The escape sequences of unknown keys are skipped.
+func parseKeys(b []byte) []key {
+	var keys []key
+	for len(b) > 0 {
+		switch b[0] {
+		case '\x1b':
+			k, n := parseEscape(b)
+			if k != 0 {
+				keys = append(keys, k)
+			}
+			b = b[n:]
+			continue
+		case '\r', '\n':
+			keys = append(keys, keyEnter)
+		case '\x7f', '\b':
+			keys = append(keys, keyBackspace)
+		case '\x03':
+			keys = append(keys, keyInterrupt)
+		default:
+			r, n := utf8.DecodeRune(b)
+			if r >= ' ' {
+				keys = append(keys, key(r))
+			}
+			b = b[n:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// parseEscape returns the key of the escape sequence at the start of b and
+// its length, 0 when the key is unknown.
+func parseEscape(b []byte) (key, int) {
+	if len(b) == 1 {
+		return keyEscape, 1
+	}
+	switch b[1] {
+	case 'O':
+		// SS3 sequences of the arrows, home and end in application mode
+		if len(b) < 3 {
+			return 0, len(b)
+		}
+		return map[byte]key{'A': keyUp, 'B': keyDown, 'H': keyHome, 'F': keyEnd}[b[2]], 3
+	case '[':
+	default:
+		return keyEscape, 1
+	}
+	// CSI sequences end with a byte in the range @ to ~
+	n := 2
+	for n < len(b) && (b[n] < 0x40 || b[n] > 0x7e) {
+		n++
+	}
+	if n == len(b) {
+		return 0, n
+	}
+	switch string(b[2 : n+1]) {
+	case "A":
+		return keyUp, n + 1
+	case "B":
+		return keyDown, n + 1
+	case "H", "1~", "7~":
+		return keyHome, n + 1
+	case "F", "4~", "8~":
+		return keyEnd, n + 1
+	case "5~":
+		return keyPageUp, n + 1
+	case "6~":
+		return keyPageDown, n + 1
+	}
+	return 0, n + 1
+}
+
+// sanitize returns the line as displayed by a terminal without its control
+// sequences, only the text after the last carriage return is kept and the
+// tabs are expanded.
+func sanitize(line string) string {
+	line = strings.TrimRight(line, "\r")
+	if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+	var (
+		b      strings.Builder
+		column int
+	)
+	for i := 0; i < len(line); {
+		r, n := utf8.DecodeRuneInString(line[i:])
+		i += n
+		switch {
+		case r == '\x1b':
+			i += escapeLength(line[i:])
+		case r == '\t':
+			for spaces := 8 - column%8; spaces > 0; spaces-- {
+				b.WriteByte(' ')
+				column++
+			}
+		case r < ' ' || r == '\x7f':
+		default:
+			b.WriteRune(r)
+			column++
+		}
+	}
+	return b.String()
+}
+
+// escapeLength returns the length of the escape sequence following an escape.
+func escapeLength(s string) int {
+	if s == "" {
+		return 0
+	}
+	switch s[0] {
+	case '[':
+		for i := 1; i < len(s); i++ {
+			if s[i] >= 0x40 && s[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(s)
+	case ']':
+		// operating system commands end with a bell or a string terminator
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\a' {
+				return i + 1
+			}
+			if s[i] == '\x1b' && i+1 < len(s) && s[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(s)
+	}
+	return 1
+}
+
+// searchLines returns the index of the next line containing the query, ignoring
+// the case, from the line at from in the direction dir wrapping around, -1 when
+// no line contains it.
+func searchLines(lines []string, query string, from, dir int) int {
+	query = strings.ToLower(query)
+	for n := 0; n < len(lines); n++ {
+		i := ((from+n*dir)%len(lines) + len(lines)) % len(lines)
+		if strings.Contains(strings.ToLower(sanitize(lines[i])), query) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hostFilter selects the hosts of the list of the terminal UI.
+type hostFilter int
+
+const (
+	filterAll hostFilter = iota
+	filterFailed
+	filterRunning
+)
+
+func (f hostFilter) String() string {
+	return [...]string{"all", "failed", "running"}[f]
+}
+
+// filterJobs returns the jobs selected by the filter.
+func filterJobs(jobs []*job, f hostFilter) []*job {
+	var res []*job
+	for _, j := range jobs {
+		j.mu.Lock()
+		state, err := j.state, j.err
+		j.mu.Unlock()
+		switch {
+		case f == filterFailed && (state != finished || err == nil):
+		case f == filterRunning && state != running:
+		default:
+			res = append(res, j)
+		}
+	}
+	return res
+}
+
+// tui is the full-screen terminal UI listing the hosts with the whole output of
+// the selected host. It's driven by a single goroutine, see run.
+type tui struct {
+	jobs  []*job
+	out   io.Writer
+	fd    int
+	state *terminal.State
+	// logs are the logs written while the terminal UI is shown
+	logs   bytes.Buffer
+	logOut io.Writer
+
+	width, height int
+	filter        hostFilter
+	selected      *job
+	// listTop is the first job of the list displayed
+	listTop int
+	// top is the first line of the output displayed unless follow is true,
+	// then the last lines are displayed as they are written
+	top    int
+	follow bool
+	// query is the search, input is the search being typed while searching
+	query, input string
+	searching    bool
+	// match is the line of the output matching the search, -1 when none
+	match int
+	// message is displayed in the status line until the next key
+	message string
+	// quitting is true once asked to confirm canceling the running hosts
+	quitting bool
+	// retry runs a finished job again
+	retry func(j *job) error
+	// quit is closed once the user quits
+	quit    chan struct{}
+	stopped bool
+}
+
+// newTUI switches the terminal to raw mode and the alternate screen to show
+// the jobs, the terminal is restored once the user quits.
+func newTUI(jobs []*job) (*tui, error) {
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no hosts to show")
+	}
+	fd := int(os.Stdin.Fd())
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	t := &tui{
+		jobs:     jobs,
+		out:      colorable.NewColorableStdout(),
+		fd:       fd,
+		state:    state,
+		logOut:   log.StandardLogger().Out,
+		width:    width,
+		height:   height,
+		selected: jobs[0],
+		follow:   true,
+		match:    -1,
+		quit:     make(chan struct{}),
+	}
+	// the logs would be written over the screen
+	log.SetOutput(&t.logs)
+	io.WriteString(t.out, escape+"[?1049h"+escape+"[?25l")
+	return t, nil
+}
+
+// run handles the keys and renders the jobs each time they change until the
+// signal channel is closed, the final state of each job is then printed.
+func (t *tui) run(signal <-chan struct{}) {
+	keys := make(chan []key)
+	go readKeys(os.Stdin, keys, t.quit)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var (
+		dirty    = true
+		rendered time.Time
+	)
+	for {
+		select {
+		case _, ok := <-signal:
+			if !ok {
+				t.stop()
+				for _, j := range t.jobs {
+					j.mu.Lock()
+					fmt.Fprintln(t.out, formatHostLine(j))
+					j.mu.Unlock()
+				}
+				return
+			}
+			dirty = true
+			continue
+		case ks := <-keys:
+			for _, k := range ks {
+				t.handle(k)
+			}
+		case <-ticker.C:
+			if w, h, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil && (w != t.width || h != t.height) {
+				t.width, t.height = w, h
+				dirty = true
+			}
+			// the elapsed time of the running jobs is updated every second
+			if !dirty && time.Since(rendered) < time.Second {
+				continue
+			}
+		}
+		if !t.stopped {
+			t.render()
+			dirty, rendered = false, time.Now()
+		}
+	}
+}
+
+// readKeys sends the keys read from r until done is closed.
+func readKeys(r io.Reader, keys chan<- []key, done <-chan struct{}) {
+	buf := make([]byte, 256)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case keys <- parseKeys(buf[:n]):
+		case <-done:
+			return
+		}
+	}
+}
+
+// stop restores the terminal and the logs written meanwhile.
+func (t *tui) stop() {
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+	io.WriteString(t.out, escape+"[?25h"+escape+"[?1049l")
+	terminal.Restore(t.fd, t.state)
+	log.SetOutput(t.logOut)
+	t.logOut.Write(t.logs.Bytes())
+}
+
+// handle executes the action of the key.
+func (t *tui) handle(k key) {
+	if t.stopped {
+		return
+	}
+	if t.searching {
+		switch k {
+		case keyEnter:
+			t.searching, t.query = false, t.input
+			t.find(t.top, 1)
+		case keyEscape, keyInterrupt:
+			t.searching = false
+		case keyBackspace:
+			if len(t.input) > 0 {
+				_, n := utf8.DecodeLastRuneInString(t.input)
+				t.input = t.input[:len(t.input)-n]
+			}
+		default:
+			if k > 0 {
+				t.input += string(rune(k))
+			}
+		}
+		return
+	}
+
+	t.message = ""
+	if k != 'q' && k != keyInterrupt {
+		t.quitting = false
+	}
+	page := t.height - 4
+	switch k {
+	case 'q', keyInterrupt:
+		t.confirmQuit()
+	case 'j', keyDown:
+		t.move(1)
+	case 'k', keyUp:
+		t.move(-1)
+	case keyPageUp, 'b':
+		t.scroll(-page)
+	case keyPageDown, ' ':
+		t.scroll(page)
+	case 'g', keyHome:
+		t.top, t.follow = 0, false
+	case 'G', keyEnd:
+		t.follow = true
+	case '/':
+		t.searching, t.input = true, ""
+	case 'n':
+		t.find(t.match+1, 1)
+	case 'N':
+		t.find(t.match-1, -1)
+	case 'f':
+		t.filter = (t.filter + 1) % 3
+		if visible := filterJobs(t.jobs, t.filter); len(visible) > 0 && !containsJob(visible, t.selected) {
+			t.selectJob(visible[0])
+		}
+	case 'c':
+		t.cancel()
+	case 'r':
+		t.rerun()
+	}
+}
+
+// confirmQuit quits once confirmed when hosts are still running.
+func (t *tui) confirmQuit() {
+	var active int
+	for _, j := range t.jobs {
+		j.mu.Lock()
+		if j.state != finished {
+			active++
+		}
+		j.mu.Unlock()
+	}
+	if active > 0 && !t.quitting {
+		t.quitting = true
+		t.message = fmt.Sprintf("%d hosts did not finish, press q again to cancel them and quit", active)
+		return
+	}
+	close(t.quit)
+	t.stop()
+}
+
+// move selects the job n jobs after the selected job in the list.
+func (t *tui) move(n int) {
+	visible := filterJobs(t.jobs, t.filter)
+	if len(visible) == 0 {
+		return
+	}
+	i := indexJob(visible, t.selected) + n
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(visible) {
+		i = len(visible) - 1
+	}
+	t.selectJob(visible[i])
+}
+
+func (t *tui) selectJob(j *job) {
+	if j != t.selected {
+		t.selected, t.follow, t.match = j, true, -1
+	}
+}
+
+// scroll moves the output of the selected job by n lines, the output
+// follows the new lines once scrolled to the end.
+func (t *tui) scroll(n int) {
+	count, height := len(t.lines()), t.outputHeight()
+	if t.follow {
+		t.top = count - height
+	}
+	t.top += n
+	if t.top < 0 {
+		t.top = 0
+	}
+	t.follow = t.top >= count-height
+}
+
+// find displays the next line of the output matching the search.
+func (t *tui) find(from, dir int) {
+	if t.query == "" {
+		return
+	}
+	lines := t.lines()
+	i := searchLines(lines, t.query, from, dir)
+	if i < 0 {
+		t.message, t.match = fmt.Sprintf("%q not found", t.query), -1
+		return
+	}
+	t.match = i
+	height := t.outputHeight()
+	if t.follow {
+		t.top = len(lines) - height
+	}
+	if i < t.top || i >= t.top+height {
+		t.top = i - height/2
+	}
+	if t.top < 0 {
+		t.top = 0
+	}
+	t.follow = false
+}
+
+// cancel cancels the selected job unless it finished.
+func (t *tui) cancel() {
+	j := t.selected
+	j.mu.Lock()
+	state := j.state
+	j.mu.Unlock()
+	if state == finished {
+		t.message = fmt.Sprintf("%s already finished", j.name)
+		return
+	}
+	j.stop()
+	t.message = fmt.Sprintf("canceling %s", j.name)
+}
+
+// rerun runs the selected job again once it finished.
+func (t *tui) rerun() {
+	j := t.selected
+	j.mu.Lock()
+	state := j.state
+	j.mu.Unlock()
+	if state != finished {
+		t.message = fmt.Sprintf("%s did not finish", j.name)
+		return
+	}
+	if err := t.retry(j); err != nil {
+		t.message = fmt.Sprintf("failed to retry %s - %v", j.name, err)
+		return
+	}
+	t.follow, t.match = true, -1
+	t.message = fmt.Sprintf("retrying %s", j.name)
+}
+
+// lines returns the output of the selected job.
+func (t *tui) lines() []string {
+	t.selected.mu.Lock()
+	defer t.selected.mu.Unlock()
+	return append([]string(nil), t.selected.lines...)
+}
+
+// outputHeight is the number of lines of output displayed, below the header,
+// the title of the output and above the status line.
+func (t *tui) outputHeight() int {
+	if h := t.height - 3; h > 0 {
+		return h
+	}
+	return 1
+}
+
+// render draws the whole screen, the header with the number of jobs in each
+// state, the list of the jobs next to the output of the selected job and the
+// status line.
+func (t *tui) render() {
+	var (
+		b       bytes.Buffer
+		visible = filterJobs(t.jobs, t.filter)
+		width   = t.width
+		listW   = width / 3
+	)
+	switch {
+	case listW < 28:
+		listW = 28
+	case listW > 48:
+		listW = 48
+	}
+	if listW > width-10 {
+		listW = width - 10
+	}
+	outputW := width - listW - 1
+
+	b.WriteString(escape + "[H")
+	t.header(&b, width)
+	body := t.height - 2
+	if i := indexJob(visible, t.selected); i >= 0 {
+		if i < t.listTop {
+			t.listTop = i
+		}
+		if i >= t.listTop+body {
+			t.listTop = i - body + 1
+		}
+	}
+	if t.listTop > len(visible)-body {
+		t.listTop = len(visible) - body
+	}
+	if t.listTop < 0 {
+		t.listTop = 0
+	}
+	output := t.output(outputW, body, containsJob(visible, t.selected))
+	for row := 0; row < body; row++ {
+		fmt.Fprintf(&b, "%s[%d;1H", escape, row+2)
+		if i := t.listTop + row; i < len(visible) {
+			t.listRow(&b, visible[i], listW)
+		} else {
+			b.WriteString(pad("", listW))
+		}
+		b.WriteString("│")
+		b.WriteString(output[row])
+		b.WriteString(escape + "[K")
+	}
+	fmt.Fprintf(&b, "%s[%d;1H", escape, t.height)
+	t.statusLine(&b, width)
+	t.out.Write(b.Bytes())
+}
+
+// header writes the number of jobs in each state and the filter.
+func (t *tui) header(b *bytes.Buffer, width int) {
+	var counts [4]int
+	for _, j := range t.jobs {
+		j.mu.Lock()
+		switch {
+		case j.state == finished && j.err != nil:
+			counts[3]++
+		case j.state == finished:
+			counts[2]++
+		case j.state == running:
+			counts[1]++
+		default:
+			counts[0]++
+		}
+		j.mu.Unlock()
+	}
+	text := fmt.Sprintf(" slex: %d hosts, %d pending, %d running, %d ok, %d failed", len(t.jobs), counts[0], counts[1], counts[2], counts[3])
+	if t.filter != filterAll {
+		text += fmt.Sprintf(" - showing %s hosts", t.filter)
+	}
+	b.WriteString(escape + "[7m" + pad(text, width) + reset + escape + "[K")
+}
+
+// listRow writes the state, the name, the exit status and the elapsed time of the job.
+func (t *tui) listRow(b *bytes.Buffer, j *job, width int) {
+	j.mu.Lock()
+	var glyph, color string
+	switch {
+	case j.state == finished && j.err != nil:
+		glyph, color = "✘", red
+	case j.state == finished:
+		glyph, color = "✔", green
+	case j.state == running:
+		glyph, color = "●", escape+"[33m"
+	default:
+		glyph = "·"
+	}
+	exit := exitColumn(j)
+	var elapsed string
+	switch {
+	case j.started.IsZero():
+	case j.ended.IsZero():
+		elapsed = formatElapsed(time.Since(j.started))
+	default:
+		elapsed = formatElapsed(j.ended.Sub(j.started))
+	}
+	name := j.name
+	j.mu.Unlock()
+
+	if j == t.selected {
+		b.WriteString(escape + "[7m")
+	}
+	nameW := width - 16
+	if nameW < 1 {
+		nameW = 1
+	}
+	fmt.Fprintf(b, " %s%s%s %s %4s %7s ", color, glyph, escape+"[39m", pad(name, nameW), exit, elapsed)
+	b.WriteString(reset)
+}
+
+// exitColumn returns the exit status of the finished job, err when the
+// command did not exit or did not meet the expectations.
+func exitColumn(j *job) string {
+	if j.state != finished {
+		return ""
+	}
+	switch e := j.err.(type) {
+	case nil:
+		return "0"
+	case *ssh.ExitError:
+		return strconv.Itoa(e.ExitStatus())
+	}
+	return "err"
+}
+
+// formatElapsed returns the duration in seconds with a decimal under a
+// minute, in minutes and seconds otherwise.
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// output returns the rows of the output pane, the title of the selected job
+// followed by its output from the top line or its last lines when following.
+func (t *tui) output(width, height int, show bool) []string {
+	rows := make([]string, height)
+	if !show || height == 0 {
+		return rows
+	}
+	j := t.selected
+	j.mu.Lock()
+	title := " " + j.name
+	if j.user != "" {
+		title += fmt.Sprintf(" (%s@%s)", j.user, j.host)
+	}
+	switch {
+	case j.state == finished && j.err != nil:
+		title += ": " + j.err.Error()
+	case j.state == finished:
+		title += ": ok"
+	default:
+		title += ": " + strings.ToLower(getState(j.state))
+		if j.progress != "" {
+			title += " " + j.progress
+		}
+	}
+	n := height - 1
+	if t.follow || t.top > len(j.lines)-n {
+		t.top = len(j.lines) - n
+	}
+	if t.top < 0 {
+		t.top = 0
+	}
+	// the last line is updated by the writer of the job until it's terminated
+	lines := append([]string(nil), j.lines[t.top:]...)
+	j.mu.Unlock()
+
+	rows[0] = escape + "[1m" + pad(title, width) + reset
+	for i := 0; i < n && i < len(lines); i++ {
+		line := []rune(sanitize(lines[i]))
+		if len(line) > width {
+			line = line[:width]
+		}
+		rows[i+1] = highlight(line, t.query)
+	}
+	return rows
+}
+
+// highlight returns the line with the occurrences of the query, ignoring the
+// case, in reverse video.
+func highlight(line []rune, query string) string {
+	q := []rune(strings.ToLower(query))
+	if len(q) == 0 {
+		return string(line)
+	}
+	lower := []rune(strings.ToLower(string(line)))
+	if len(lower) != len(line) {
+		return string(line)
+	}
+	var b strings.Builder
+	for i := 0; i < len(line); {
+		if i+len(q) <= len(line) && string(lower[i:i+len(q)]) == string(q) {
+			b.WriteString(escape + "[7m" + string(line[i:i+len(q)]) + escape + "[27m")
+			i += len(q)
+			continue
+		}
+		b.WriteRune(line[i])
+		i++
+	}
+	return b.String()
+}
+
+// statusLine writes the search being typed, the message of the last key or the keys.
+func (t *tui) statusLine(b *bytes.Buffer, width int) {
+	switch {
+	case t.searching:
+		b.WriteString(pad("/"+t.input, width))
+	case t.message != "":
+		b.WriteString(pad(t.message, width))
+	default:
+		b.WriteString(escape + "[2m" + pad("j/k select  PgUp/PgDn g/G scroll  / search  n/N next/previous match  f filter  c cancel  r retry  q quit", width) + reset)
+	}
+	b.WriteString(escape + "[K")
+}
+
+// pad returns s truncated or padded with spaces to width runes.
+func pad(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		return string([]rune(s)[:width])
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+func indexJob(jobs []*job, j *job) int {
+	for i, v := range jobs {
+		if v == j {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsJob(jobs []*job, j *job) bool {
+	return indexJob(jobs, j) >= 0
+}
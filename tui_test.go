@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []key
+	}{
+		{"jk/", []key{'j', 'k', '/'}},
+		{"\x1b[A\x1b[B\x1bOA", []key{keyUp, keyDown, keyUp}},
+		{"\x1b[5~\x1b[6~\x1b[H\x1b[4~", []key{keyPageUp, keyPageDown, keyHome, keyEnd}},
+		{"\x1b", []key{keyEscape}},
+		{"\x1bq", []key{keyEscape, 'q'}},
+		// unknown sequences are skipped
+		{"\x1b[1;5Cn", []key{'n'}},
+		{"ab\x7f\r\x03", []key{'a', 'b', keyBackspace, keyEnter, keyInterrupt}},
+		{"é", []key{'é'}},
+	} {
+		if keys := parseKeys([]byte(tc.input)); !reflect.DeepEqual(keys, tc.expected) {
+			t.Errorf("expected the keys of %q to be %v, got %v", tc.input, tc.expected, keys)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"\x1b[1;31merror\x1b[0m: failed", "error: failed"},
+		{"a\tb", "a       b"},
+		{"12345678\tb", "12345678        b"},
+		{" 10%\r 50%\r100%", "100%"},
+		{"done\r", "done"},
+		{"\x1b]0;title\adone\x07", "done"},
+	} {
+		if s := sanitize(tc.line); s != tc.expected {
+			t.Errorf("expected %q to be sanitized as %q, got %q", tc.line, tc.expected, s)
+		}
+	}
+}
+
+func TestSearchLines(t *testing.T) {
+	lines := []string{"starting", "Error: disk full", "retrying", "error: disk full"}
+	for _, tc := range []struct {
+		from, dir int
+		expected  int
+	}{
+		{0, 1, 1},
+		{2, 1, 3},
+		{0, -1, 3},
+		{3, -1, 3},
+		{2, -1, 1},
+	} {
+		if i := searchLines(lines, "ERROR", tc.from, tc.dir); i != tc.expected {
+			t.Errorf("expected the search from %d in direction %d to find %d, got %d", tc.from, tc.dir, tc.expected, i)
+		}
+	}
+	if i := searchLines(lines, "timeout", 0, 1); i != -1 {
+		t.Errorf("expected no line to match, got %d", i)
+	}
+}
+
+func TestFilterJobs(t *testing.T) {
+	var (
+		pendingJob = &job{name: "pending", state: pending}
+		runningJob = &job{name: "running", state: running}
+		okJob      = &job{name: "ok", state: finished}
+		failedJob  = &job{name: "failed", state: finished, err: errors.New("failed")}
+		jobs       = []*job{pendingJob, runningJob, okJob, failedJob}
+	)
+	for _, tc := range []struct {
+		filter   hostFilter
+		expected []*job
+	}{
+		{filterAll, jobs},
+		{filterFailed, []*job{failedJob}},
+		{filterRunning, []*job{runningJob}},
+	} {
+		if res := filterJobs(jobs, tc.filter); !reflect.DeepEqual(res, tc.expected) {
+			t.Errorf("expected the %s jobs to be %v, got %v", tc.filter, tc.expected, res)
+		}
+	}
+}
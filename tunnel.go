@@ -0,0 +1,69 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/crosbymichael/slex/pkg/runner"
+	"github.com/urfave/cli"
+)
+
+var tunnelCommand = cli.Command{
+	Name:  "tunnel",
+	Usage: "keep the port forwards to all hosts up until interrupted",
+	Description: `The forwards are specified with -L, -R and -D or LocalForward, RemoteForward
+   and DynamicForward in the ssh config. Use auto as the local port to allocate
+   a free port for each host, i.e. slex --hosts hosts.txt -L auto:9100 tunnel`,
+	Action: tunnelAction,
+}
+
+// tunnelAction connects to all hosts at once and keeps their forwards up,
+// printing the address each forward listens on, until interrupted.
+func tunnelAction(context *cli.Context) error {
+	m, err := newMultiplexer(context)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	// the connections are kept open so every host needs its own worker
+	m.runner.SetConcurrency(len(m.hosts))
+	m.forwardConfig = true
+
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			close(interrupted)
+		}
+	}()
+
+	_, err = m.run(func(_ gocontext.Context, j *job, session *runner.Session) error {
+		if len(j.forwards) == 0 {
+			return fmt.Errorf("no forwards for the host, use -L, -R or -D")
+		}
+		lines := make([]string, len(j.forwards))
+		for i, f := range j.forwards {
+			lines[i] = f.String()
+		}
+		fmt.Fprint(newWriter(j), strings.Join(lines, "\n"))
+		j.setProgress("forwarding")
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- session.Client.Wait()
+		}()
+		select {
+		case <-interrupted:
+			return nil
+		case err := <-closed:
+			return fmt.Errorf("connection closed - %v", err)
+		}
+	})
+	return err
+}
@@ -8,21 +8,53 @@ import (
 
 func newWriter(j *job) io.Writer {
 	return &writer{
-		j: j,
+		j:    j,
+		cast: j.recording(),
 	}
 }
 
 // writer buffers all output that is written to it until it's closed.
+// A line is continued by the following writes until it ends with a newline.
 type writer struct {
 	j *job
+	// partial is true when the last line of the job is not terminated,
+	// it's guarded by the mutex of the job
+	partial bool
+	// cast receives the output as it's written when the run is recorded
+	cast io.Writer
+	// attached is true when the output is displayed as it's written by the
+	// attached terminal, the rendering of the lines is not throttled then
+	attached bool
 }
 
 func (w *writer) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if w.cast != nil {
+		// a failure to record is reported once the job finishes
+		w.cast.Write(p)
+	}
 	lines := bytes.Split(p, []byte("\n"))
-	for _, l := range lines {
-		w.j.lines = append(w.j.lines, string(l))
+	terminated := len(lines[len(lines)-1]) == 0
+	if terminated {
+		lines = lines[:len(lines)-1]
+	}
+	for i, l := range lines {
+		w.j.mu.Lock()
+		if i == 0 && w.partial && len(w.j.lines) > 0 {
+			w.j.lines[len(w.j.lines)-1] += string(l)
+		} else {
+			w.j.lines = append(w.j.lines, string(l))
+		}
+		if i == len(lines)-1 {
+			w.partial = !terminated
+		}
+		w.j.mu.Unlock()
 		w.j.signal <- struct{}{}
-		time.Sleep(50 * time.Millisecond)
+		if !w.attached {
+			time.Sleep(50 * time.Millisecond)
+		}
 	}
 	//w.j.signal <- struct{}{}
 	return len(p), nil